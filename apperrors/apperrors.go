@@ -0,0 +1,185 @@
+// Package apperrors defines the app's error codes, which clients can rely on rather than matching messages,
+// and renders errors as RFC 7807 problem details.
+package apperrors
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/validation"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// A stable identifier for a kind of error, e.g. USER_NOT_FOUND
+type Code string
+
+const (
+	InvalidRequest       Code = "INVALID_REQUEST"
+	InvalidID            Code = "INVALID_ID"
+	InvalidCursor        Code = "INVALID_CURSOR"
+	InvalidPatch         Code = "INVALID_PATCH"
+	PatchConflict        Code = "PATCH_CONFLICT"
+	UnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+	ValidationFailed     Code = "VALIDATION_FAILED"
+	Unauthenticated      Code = "UNAUTHENTICATED"
+	InvalidAPIKey        Code = "INVALID_API_KEY"
+	Forbidden            Code = "FORBIDDEN"
+	RouteNotFound        Code = "ROUTE_NOT_FOUND"
+	UserNotFound         Code = "USER_NOT_FOUND"
+	APIKeyNotFound       Code = "API_KEY_NOT_FOUND"
+	UserModified         Code = "USER_MODIFIED"
+	UserNotDeleted       Code = "USER_NOT_DELETED"
+	RequestTimeout       Code = "REQUEST_TIMEOUT"
+	RequestCancelled     Code = "REQUEST_CANCELLED"
+	Conflict             Code = "CONFLICT"
+	InvalidInput         Code = "INVALID_INPUT"
+	DatabaseUnavailable  Code = "DATABASE_UNAVAILABLE"
+	Internal             Code = "INTERNAL_ERROR"
+)
+
+type entry struct {
+	Status int
+	Title  string
+}
+
+// The status and title of every code. Codes are never renamed or given another status once released.
+var catalog = map[Code]entry{
+	InvalidRequest:       {fiber.StatusBadRequest, "Invalid request"},
+	InvalidID:            {fiber.StatusBadRequest, "Invalid ID"},
+	InvalidCursor:        {fiber.StatusBadRequest, "Invalid cursor"},
+	InvalidPatch:         {fiber.StatusBadRequest, "Invalid patch"},
+	PatchConflict:        {fiber.StatusConflict, "Patch could not be applied"},
+	UnsupportedMediaType: {fiber.StatusUnsupportedMediaType, "Unsupported media type"},
+	ValidationFailed:     {fiber.StatusUnprocessableEntity, "Validation failed"},
+	Unauthenticated:      {fiber.StatusUnauthorized, "Authentication required"},
+	InvalidAPIKey:        {fiber.StatusUnauthorized, "Invalid API key"},
+	Forbidden:            {fiber.StatusForbidden, "Forbidden"},
+	RouteNotFound:        {fiber.StatusNotFound, "Route not found"},
+	UserNotFound:         {fiber.StatusNotFound, "User not found"},
+	APIKeyNotFound:       {fiber.StatusNotFound, "API key not found"},
+	UserModified:         {fiber.StatusPreconditionFailed, "User has been modified"},
+	UserNotDeleted:       {fiber.StatusConflict, "User is not deleted"},
+	RequestTimeout:       {fiber.StatusGatewayTimeout, "Request timed out"},
+	RequestCancelled:     {fiber.StatusServiceUnavailable, "Request cancelled"},
+	Conflict:             {fiber.StatusConflict, "Conflict"},
+	InvalidInput:         {fiber.StatusUnprocessableEntity, "Invalid input"},
+	DatabaseUnavailable:  {fiber.StatusServiceUnavailable, "Database unavailable"},
+	Internal:             {fiber.StatusInternalServerError, "Internal server error"},
+}
+
+type Error struct {
+	Code   Code
+	Detail string                  // Explains this occurrence of the error to the client
+	Fields []validation.FieldError // The invalid fields, for VALIDATION_FAILED
+	Err    error                   // The cause, which is logged but never shown to clients
+
+	RetryAfter time.Duration // Sent as a Retry-After header, if set
+}
+
+func New(code Code, detail string) *Error {
+	return &Error{Code: code, Detail: detail}
+}
+
+// An error whose cause is kept for logs, e.g. apperrors.Wrap(apperrors.Internal, "sorry, something went wrong", err)
+func Wrap(code Code, detail string, err error) *Error {
+	return &Error{Code: code, Detail: detail, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// The HTTP status of the error's code, or of the Fiber error it wraps for codes outside the catalog
+func (e *Error) Status() int {
+	if entry, ok := catalog[e.Code]; ok {
+		return entry.Status
+	}
+	var fiberError *fiber.Error
+	if errors.As(e.Err, &fiberError) {
+		return fiberError.Code
+	}
+	return fiber.StatusInternalServerError
+}
+
+func (e *Error) Title() string {
+	if entry, ok := catalog[e.Code]; ok {
+		return entry.Title
+	}
+	return utils.StatusMessage(e.Status())
+}
+
+// Whether err is an *Error with the given code
+func Is(err error, code Code) bool {
+	var appError *Error
+	return errors.As(err, &appError) && appError.Code == code
+}
+
+// Converts any error to an *Error. Errors that weren't meant for clients become INTERNAL_ERROR,
+// with a generic detail so that nothing is leaked.
+func From(err error) *Error {
+	var appError *Error
+	var validationError *validation.Error
+	var fiberError *fiber.Error
+	switch {
+	case errors.As(err, &appError):
+		return appError
+	case errors.As(err, &validationError):
+		return &Error{Code: ValidationFailed, Detail: validationError.Error(), Fields: validationError.Fields, Err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return Wrap(RequestTimeout, "request timed out", err)
+	case errors.Is(err, context.Canceled):
+		return Wrap(RequestCancelled, "request was cancelled, please retry", err)
+	case errors.As(err, &fiberError):
+		return fromFiber(fiberError)
+	}
+	return Wrap(Internal, "sorry, something went wrong", err)
+}
+
+// Fiber's own errors, such as for unknown routes, are given a code derived from their status e.g. METHOD_NOT_ALLOWED
+func fromFiber(err *fiber.Error) *Error {
+	if err.Code == fiber.StatusNotFound {
+		return Wrap(RouteNotFound, err.Message, err)
+	}
+	code := strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_").Replace(utils.StatusMessage(err.Code)))
+	return Wrap(Code(code), err.Message, err)
+}
+
+const MIMEProblemJSON = "application/problem+json"
+
+// An RFC 7807 problem details object, with the error's code, the request ID and any invalid fields as extensions
+type Problem struct {
+	Type      string                  `json:"type"`
+	Title     string                  `json:"title"`
+	Status    int                     `json:"status"`
+	Detail    string                  `json:"detail"`
+	Instance  string                  `json:"instance"`
+	Code      Code                    `json:"code"`
+	RequestID string                  `json:"request_id,omitempty"`
+	Errors    []validation.FieldError `json:"errors,omitempty"`
+}
+
+// Describes the error as it occurred at instance, the path of the request
+func (e *Error) Problem(instance, requestID string) Problem {
+	return Problem{
+		Type:      TypeURI(e.Code),
+		Title:     e.Title(),
+		Status:    e.Status(),
+		Detail:    e.Detail,
+		Instance:  instance,
+		Code:      e.Code,
+		RequestID: requestID,
+		Errors:    e.Fields,
+	}
+}
+
+// A relative URI identifying the code e.g. /problems/user-not-found
+func TypeURI(code Code) string {
+	return "/problems/" + strings.ReplaceAll(strings.ToLower(string(code)), "_", "-")
+}
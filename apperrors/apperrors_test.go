@@ -0,0 +1,66 @@
+package apperrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/conormkelly/fiber-demo/validation"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrom(t *testing.T) {
+	validationError := &validation.Error{Fields: []validation.FieldError{{Field: "last_name", Rule: "required", Message: "is required"}}}
+
+	testCases := []struct {
+		err            error
+		expectedCode   Code
+		expectedStatus int
+		expectedDetail string
+	}{
+		{New(UserNotFound, "user does not exist"), UserNotFound, 404, "user does not exist"},
+		{fmt.Errorf("loading user: %w", New(UserModified, "user has been modified")), UserModified, 412, "user has been modified"},
+		{validationError, ValidationFailed, 422, "validation failed"},
+		{errors.Join(context.DeadlineExceeded, errors.New("i/o timeout")), RequestTimeout, 504, "request timed out"},
+		{context.Canceled, RequestCancelled, 503, "request was cancelled, please retry"},
+		{fiber.ErrNotFound, RouteNotFound, 404, "Not Found"},
+		{fiber.ErrMethodNotAllowed, "METHOD_NOT_ALLOWED", 405, "Method Not Allowed"},
+		{errors.New("Error 1045: Access denied for user 'app'"), Internal, 500, "sorry, something went wrong"},
+	}
+
+	for _, test := range testCases {
+		appError := From(test.err)
+		assert.Equal(t, test.expectedCode, appError.Code, test.err.Error())
+		assert.Equal(t, test.expectedStatus, appError.Status(), test.err.Error())
+		assert.Equal(t, test.expectedDetail, appError.Detail, test.err.Error())
+	}
+
+	assert.Equal(t, validationError.Fields, From(validationError).Fields)
+	assert.True(t, Is(fmt.Errorf("wrapped: %w", New(Forbidden, "no")), Forbidden))
+	assert.False(t, Is(errors.New("no"), Forbidden))
+}
+
+func TestProblem(t *testing.T) {
+	problem := New(UserNotFound, "user does not exist").Problem("/api/users/1", "abc123")
+	assert.Equal(t, Problem{
+		Type:      "/problems/user-not-found",
+		Title:     "User not found",
+		Status:    404,
+		Detail:    "user does not exist",
+		Instance:  "/api/users/1",
+		Code:      UserNotFound,
+		RequestID: "abc123",
+	}, problem)
+
+	unknown := Wrap("TOO_MANY_REQUESTS", "slow down", fiber.ErrTooManyRequests)
+	assert.Equal(t, 429, unknown.Status(), "codes outside the catalog use the wrapped Fiber error's status")
+	assert.Equal(t, "Too Many Requests", unknown.Title())
+	assert.Equal(t, 500, New("UNKNOWN", "").Status())
+
+	for code, entry := range catalog {
+		assert.NotEmpty(t, entry.Title, code)
+		assert.GreaterOrEqual(t, entry.Status, 400, code)
+	}
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// The fiber.Ctx locals key that the authenticated caller's claims are stored under
+const ClaimsKey = "claims"
+
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"-"` // Set for API key callers, who may only perform these actions. Never read from a token.
+}
+
+// Returns the claims of the authenticated caller, or nil if the request wasn't authenticated
+func ClaimsFrom(ctx *fiber.Ctx) *Claims {
+	claims, _ := ctx.Locals(ClaimsKey).(*Claims)
+	return claims
+}
+
+func (claims *Claims) HasRole(role string) bool {
+	for _, r := range claims.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an API key caller was granted the action. Callers with a token have no scopes.
+func (claims *Claims) HasScope(action string) bool {
+	for _, scope := range claims.Scopes {
+		if scope == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKey = errors.New("no key matches the token")
+
+// Provides the keys used to verify bearer tokens
+type KeySource interface {
+	// Returns the key that verifies a token signed with the given algorithm and key ID (kid header)
+	Key(alg, kid string) (interface{}, error)
+}
+
+// A verification key, optionally identified by a key ID.
+// Keys without an ID are tried for any token of a matching algorithm.
+type Key struct {
+	ID  string
+	Key interface{} // []byte for HS256, *rsa.PublicKey for RS256, ed25519.PublicKey for EdDSA
+}
+
+type KeySet []Key
+
+// Only keys of the type the algorithm expects are considered,
+// so that e.g. an RSA public key can never be used as an HMAC secret.
+func (set KeySet) Key(alg, kid string) (interface{}, error) {
+	for _, key := range set {
+		if kid != "" && key.ID != "" && key.ID != kid {
+			continue
+		}
+
+		switch key.Key.(type) {
+		case []byte:
+			if alg == "HS256" {
+				return key.Key, nil
+			}
+		case *rsa.PublicKey:
+			if alg == "RS256" {
+				return key.Key, nil
+			}
+		case ed25519.PublicKey:
+			if alg == "EdDSA" {
+				return key.Key, nil
+			}
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// A shared HS256 secret
+func Secret(secret []byte) KeySource {
+	return KeySet{{Key: secret}}
+}
+
+// Tries each source in turn
+type KeySources []KeySource
+
+func (sources KeySources) Key(alg, kid string) (interface{}, error) {
+	for _, source := range sources {
+		if key, err := source.Key(alg, kid); err == nil {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Keys loaded from a local PEM or JWKS file, which are reloaded when the file changes so that keys can be rotated.
+// The file is checked at most once per RefreshInterval, or straight away when a token has an unknown key ID.
+type FileKeySource struct {
+	Path            string
+	RefreshInterval time.Duration
+	Logger          *slog.Logger // Logs files that fail to reload, defaults to slog.Default()
+
+	mutex     sync.RWMutex
+	keys      KeySet
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func NewFileKeySource(path string, refreshInterval time.Duration) (*FileKeySource, error) {
+	source := &FileKeySource{Path: path, RefreshInterval: refreshInterval}
+	if err := source.reload(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func (source *FileKeySource) Key(alg, kid string) (interface{}, error) {
+	source.refresh(false)
+
+	source.mutex.RLock()
+	key, err := source.keys.Key(alg, kid)
+	source.mutex.RUnlock()
+
+	if errors.Is(err, ErrUnknownKey) && kid != "" && source.refresh(true) {
+		source.mutex.RLock()
+		defer source.mutex.RUnlock()
+		return source.keys.Key(alg, kid)
+	}
+	return key, err
+}
+
+// Reloads the keys if the file has changed, reporting whether it did.
+// A file that fails to load is logged and the previous keys are kept.
+func (source *FileKeySource) refresh(force bool) bool {
+	source.mutex.RLock()
+	due := force || time.Since(source.lastCheck) >= source.RefreshInterval
+	source.mutex.RUnlock()
+	if !due {
+		return false
+	}
+
+	info, err := os.Stat(source.Path)
+
+	source.mutex.Lock()
+	source.lastCheck = time.Now()
+	changed := err == nil && !info.ModTime().Equal(source.modTime)
+	source.mutex.Unlock()
+
+	if !changed {
+		return false
+	}
+	if err := source.reload(); err != nil {
+		logger := source.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("Failed to reload keys.", "path", source.Path, "error", err)
+		return false
+	}
+	return true
+}
+
+func (source *FileKeySource) reload() error {
+	info, err := os.Stat(source.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(source.Path)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source.Path, err)
+	}
+
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	source.keys = keys
+	source.modTime = info.ModTime()
+	source.lastCheck = time.Now()
+	return nil
+}
+
+// Parses either a JWKS document or one or more PEM encoded public keys / certificates.
+// PEM blocks can be given a key ID with a "kid" header.
+func ParseKeys(data []byte) (KeySet, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJWKS(trimmed)
+	}
+
+	var keys KeySet
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var certificate *x509.Certificate
+			if certificate, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = certificate.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, Key{ID: block.Headers["kid"], Key: key})
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	K   string `json:"k"`
+}
+
+func parseJWKS(data []byte) (KeySet, error) {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	var keys KeySet
+	encoding := base64.RawURLEncoding
+	for _, jwk := range document.Keys {
+		// Keys meant for encryption can't verify signatures
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch {
+		case jwk.Kty == "RSA":
+			n, err := encoding.DecodeString(jwk.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: invalid modulus", jwk.Kid)
+			}
+			e, err := encoding.DecodeString(jwk.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: invalid exponent", jwk.Kid)
+			}
+			key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys = append(keys, Key{ID: jwk.Kid, Key: key})
+		case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+			x, err := encoding.DecodeString(jwk.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %s: invalid Ed25519 public key", jwk.Kid)
+			}
+			keys = append(keys, Key{ID: jwk.Kid, Key: ed25519.PublicKey(x)})
+		case jwk.Kty == "oct":
+			k, err := encoding.DecodeString(jwk.K)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: invalid secret", jwk.Kid)
+			}
+			keys = append(keys, Key{ID: jwk.Kid, Key: k})
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// Confirm that RS256 and EdDSA tokens verify against keys loaded from a JWKS file, picked by key ID
+func TestJWKSKeys(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPublicKey, edPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeFile(t, path, jwks(rsaJWK("rsa-1", &rsaKey.PublicKey), edJWK("ed-1", edPublicKey)))
+
+	source, err := NewFileKeySource(path, time.Minute)
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		description string
+		method      jwt.SigningMethod
+		kid         string
+		signingKey  interface{}
+		valid       bool
+	}{
+		{"RS256 token", jwt.SigningMethodRS256, "rsa-1", rsaKey, true},
+		{"EdDSA token", jwt.SigningMethodEdDSA, "ed-1", edPrivateKey, true},
+		{"RS256 token with an unknown key ID", jwt.SigningMethodRS256, "rsa-2", rsaKey, false},
+		{"RS256 token naming the EdDSA key", jwt.SigningMethodRS256, "ed-1", rsaKey, false},
+		{"HS256 token signed with the RSA public key", jwt.SigningMethodHS256, "rsa-1", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), false},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprintf("%s - %s", t.Name(), test.description), func(t *testing.T) {
+			token := jwt.NewWithClaims(test.method, jwt.RegisteredClaims{Subject: "1"})
+			token.Header["kid"] = test.kid
+			signed, err := token.SignedString(test.signingKey)
+			assert.Nil(t, err)
+
+			_, err = jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+				return source.Key(token.Method.Alg(), test.kid)
+			})
+			assert.Equal(t, test.valid, err == nil, test.description)
+		})
+	}
+}
+
+// Confirm that a rotated key file is picked up as soon as a token references a new key ID
+func TestFileKeySourceRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	writeFile(t, path, pemKey("old", &oldKey.PublicKey))
+
+	source, err := NewFileKeySource(path, time.Hour)
+	assert.Nil(t, err)
+	var logs bytes.Buffer
+	source.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	_, err = source.Key("RS256", "new")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	writeFile(t, path, pemKey("new", &newKey.PublicKey))
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+	key, err := source.Key("RS256", "new")
+	assert.Nil(t, err)
+	assert.Equal(t, &newKey.PublicKey, key)
+
+	// A broken file keeps the previous keys in use
+	writeFile(t, path, "not a key")
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	_, err = source.Key("RS256", "newer")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	key, err = source.Key("RS256", "new")
+	assert.Nil(t, err)
+	assert.Equal(t, &newKey.PublicKey, key)
+	assert.Contains(t, logs.String(), `msg="Failed to reload keys."`)
+}
+
+func TestInvalidKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.pem")
+	writeFile(t, path, "")
+	_, err := NewFileKeySource(path, time.Minute)
+	assert.NotNil(t, err)
+
+	_, err = NewFileKeySource(filepath.Join(t.TempDir(), "missing.pem"), time.Minute)
+	assert.NotNil(t, err)
+}
+
+// Helpers
+
+func writeFile(t *testing.T, path, contents string) {
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pemKey(kid string, key interface{}) string {
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"kid": kid}, Bytes: der}))
+}
+
+func jwks(keys ...string) string {
+	document := `{"keys":[`
+	for i, key := range keys {
+		if i > 0 {
+			document += ","
+		}
+		document += key
+	}
+	return document + "]}"
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) string {
+	encoding := base64.RawURLEncoding
+	n := encoding.EncodeToString(key.N.Bytes())
+	e := encoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	return fmt.Sprintf(`{"kty":"RSA","kid":"%s","use":"sig","n":"%s","e":"%s"}`, kid, n, e)
+}
+
+func edJWK(kid string, key ed25519.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"OKP","crv":"Ed25519","kid":"%s","x":"%s"}`, kid, base64.RawURLEncoding.EncodeToString(key))
+}
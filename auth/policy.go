@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Actions that can be authorized on users
+const (
+	ListUsers   = "users:list"
+	CreateUser  = "users:create"
+	ReadUser    = "users:read"
+	UpdateUser  = "users:update"
+	DeleteUser  = "users:delete"
+	RestoreUser = "users:restore"
+	PurgeUser   = "users:purge"
+)
+
+// Actions that can be authorized on API keys
+const (
+	ListKeys  = "keys:list"
+	CreateKey = "keys:create"
+	DeleteKey = "keys:delete"
+)
+
+// Actions that can be authorized on the service itself
+const (
+	ReadMetrics = "metrics:read"
+)
+
+const AdminRole = "admin"
+
+// Who may perform an action: callers with any of the roles, or the owner of the resource if Owner is set
+type Rule struct {
+	Roles []string `json:"roles,omitempty"`
+	Owner bool     `json:"owner,omitempty"`
+}
+
+// Rules keyed by action. Actions without a rule are denied to everyone.
+type Policy map[string]Rule
+
+// Admins can do anything, while everyone else can only read and update their own user
+var DefaultPolicy = Policy{
+	ListUsers:   {Roles: []string{AdminRole}},
+	CreateUser:  {Roles: []string{AdminRole}},
+	ReadUser:    {Roles: []string{AdminRole}, Owner: true},
+	UpdateUser:  {Roles: []string{AdminRole}, Owner: true},
+	DeleteUser:  {Roles: []string{AdminRole}},
+	RestoreUser: {Roles: []string{AdminRole}},
+	PurgeUser:   {Roles: []string{AdminRole}},
+	ListKeys:    {Roles: []string{AdminRole}},
+	CreateKey:   {Roles: []string{AdminRole}},
+	DeleteKey:   {Roles: []string{AdminRole}},
+	ReadMetrics: {Roles: []string{AdminRole}},
+}
+
+// Reads a JSON policy file such as {"users:read": {"roles": ["admin", "support"], "owner": true}}.
+// Its rules replace those of DefaultPolicy for the actions it lists.
+func LoadPolicy(path string) (Policy, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules Policy
+	if err := json.Unmarshal(contents, &rules); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	policy := Policy{}
+	for action, rule := range DefaultPolicy {
+		policy[action] = rule
+	}
+	for action, rule := range rules {
+		if _, ok := DefaultPolicy[action]; !ok {
+			return nil, fmt.Errorf("invalid policy file %s: unknown action '%s'", path, action)
+		}
+		policy[action] = rule
+	}
+	return policy, nil
+}
+
+// Checks whether the caller may perform the action on a resource owned by the given subject,
+// which is empty for actions that don't target a single resource.
+// When the action is denied, the reason is returned for logging.
+func (policy Policy) Authorize(claims *Claims, action, owner string) (bool, string) {
+	if claims == nil {
+		return false, "no authenticated caller"
+	}
+
+	rule, ok := policy[action]
+	if !ok {
+		return false, "no rule for " + action
+	}
+
+	// API keys aren't subject to the rules, they are granted actions directly
+	if claims.Scopes != nil {
+		if claims.HasScope(action) {
+			return true, ""
+		}
+		return false, fmt.Sprintf("%s is not in the scopes of %s", action, claims.Subject)
+	}
+
+	for _, role := range rule.Roles {
+		if claims.HasRole(role) {
+			return true, ""
+		}
+	}
+	if rule.Owner && owner != "" && claims.Subject == owner {
+		return true, ""
+	}
+
+	reason := fmt.Sprintf("subject '%s' with roles [%s] lacks any of [%s]", claims.Subject, strings.Join(claims.Roles, ", "), strings.Join(rule.Roles, ", "))
+	if rule.Owner {
+		reason += " and does not own the resource"
+	}
+	return false, reason
+}
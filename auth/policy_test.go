@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	admin := &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "1"}, Roles: []string{AdminRole}}
+	user := &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "2"}}
+
+	testCases := []struct {
+		description string
+		claims      *Claims
+		action      string
+		owner       string
+		allowed     bool
+	}{
+		{"Admin can purge anyone", admin, PurgeUser, "2", true},
+		{"Admin can list users", admin, ListUsers, "", true},
+		{"User can read themselves", user, ReadUser, "2", true},
+		{"User can update themselves", user, UpdateUser, "2", true},
+		{"User cannot read someone else", user, ReadUser, "1", false},
+		{"User cannot delete themselves", user, DeleteUser, "2", false},
+		{"User cannot list users", user, ListUsers, "", false},
+		{"Unauthenticated caller cannot do anything", nil, ReadUser, "2", false},
+		{"Unknown actions are denied", admin, "users:export", "", false},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprintf("%s - %s", t.Name(), test.description), func(t *testing.T) {
+			allowed, reason := DefaultPolicy.Authorize(test.claims, test.action, test.owner)
+			assert.Equal(t, test.allowed, allowed, test.description)
+			assert.Equal(t, test.allowed, reason == "", "a reason is only given for denials")
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writeFile(t, path, `{"users:list": {"roles": ["admin", "support"]}, "users:update": {"roles": ["admin"]}}`)
+
+	policy, err := LoadPolicy(path)
+	assert.Nil(t, err)
+
+	support := &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "3"}, Roles: []string{"support"}}
+	allowed, _ := policy.Authorize(support, ListUsers, "")
+	assert.True(t, allowed, "listed rules are replaced")
+	allowed, _ = policy.Authorize(support, UpdateUser, "3")
+	assert.False(t, allowed, "ownership can be revoked")
+	allowed, _ = policy.Authorize(support, ReadUser, "3")
+	assert.True(t, allowed, "unlisted rules keep their defaults")
+
+	writeFile(t, path, `{"users:export": {"roles": ["admin"]}}`)
+	_, err = LoadPolicy(path)
+	assert.NotNil(t, err, "unknown actions are rejected")
+
+	writeFile(t, path, `not json`)
+	_, err = LoadPolicy(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/conormkelly/fiber-demo/config"
+	"github.com/hashicorp/go-multierror"
+)
+
+// A node in the command tree, which either runs or has subcommands
+type command struct {
+	Name        string
+	Args        string // Positional arguments, for the usage line
+	Description string
+	Run         func(c *CLI, args []string) error
+	Subcommands []*command
+}
+
+// Runs commands against the app, writing their output to Out
+type CLI struct {
+	Out    io.Writer
+	Output string // text or json
+
+	// Connects to the DB, with config overridden by the command's flags
+	Connect func(flags *flag.FlagSet) (*App, error)
+
+	commandFlags *flag.FlagSet // Of the command being run
+}
+
+func NewCLI(out io.Writer) *CLI {
+	return &CLI{Out: out, Output: "text", Connect: connectFromEnv}
+}
+
+// Loads the config and connects to the DB, without validating the config that is only needed to serve
+func connectFromEnv(flags *flag.FlagSet) (*App, error) {
+	options, _, err := loadAppOptions(flags)
+	if err == nil {
+		err = options.validateDB()
+	}
+	if err != nil {
+		return nil, errors.New("invalid config - " + err.Error())
+	}
+
+	// Commands run migrations explicitly, if at all
+	options.ShouldAutoMigrate = false
+
+	app := &App{Options: options}
+	if err := app.ConnectDB(); err != nil {
+		return nil, errors.New("DB connection error - " + err.Error())
+	}
+	return app, nil
+}
+
+var commands = &command{
+	Subcommands: []*command{
+		{Name: "serve", Description: "Serve the API (the default)", Run: serveCommand},
+		{Name: "migrate", Description: "Manage the DB schema", Subcommands: []*command{
+			{Name: "status", Description: "List applied and pending migrations", Run: migrateCommand("status")},
+			{Name: "up", Description: "Apply every pending migration", Run: migrateCommand("up")},
+			{Name: "down", Description: "Roll back the latest migration", Run: migrateCommand("down")},
+			{Name: "redo", Description: "Roll back and reapply the latest migration", Run: migrateCommand("redo")},
+		}},
+		{Name: "seed", Description: "Create the users listed in a JSON file", Run: seedCommand},
+		{Name: "users", Description: "Manage users", Subcommands: []*command{
+			{Name: "list", Description: "List users", Run: listUsersCommand},
+			{Name: "get", Args: "<id>", Description: "Show a user", Run: getUserCommand},
+			{Name: "create", Description: "Create a user", Run: createUserCommand},
+			{Name: "update", Args: "<id>", Description: "Update a user's names", Run: updateUserCommand},
+			{Name: "delete", Args: "<id>", Description: "Soft delete, or purge, a user", Run: deleteUserCommand},
+		}},
+		{Name: "config", Description: "Inspect the config", Subcommands: []*command{
+			{Name: "print", Description: "Print the config read from the environment, with secrets redacted", Run: printConfigCommand},
+		}},
+	},
+}
+
+// Runs the command named by args, e.g. ["users", "get", "1", "-output", "json"]. No args serves the API.
+func (c *CLI) Run(args []string) error {
+	if len(args) == 0 {
+		return serveCommand(c, args)
+	}
+
+	cmd, path := commands, []string{}
+	for cmd.Run == nil {
+		if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+			return c.usage(cmd, path)
+		}
+		sub := cmd.subcommand(args[0])
+		if sub == nil {
+			c.usage(cmd, path)
+			return fmt.Errorf("unknown command '%s'", strings.Join(append(path, args[0]), " "))
+		}
+		cmd, path, args = sub, append(path, args[0]), args[1:]
+	}
+	return cmd.Run(c, args)
+}
+
+func (cmd *command) subcommand(name string) *command {
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (c *CLI) usage(cmd *command, path []string) error {
+	fmt.Fprintf(c.Out, "Usage: %s <command>\n\nCommands:\n", strings.Join(append([]string{"fiber-demo"}, path...), " "))
+	w := tabwriter.NewWriter(c.Out, 0, 4, 2, ' ', 0)
+	for _, sub := range cmd.Subcommands {
+		fmt.Fprintf(w, "  %s\t%s\n", strings.TrimSpace(sub.Name+" "+sub.Args), sub.Description)
+	}
+	return w.Flush()
+}
+
+// Creates the flag set of a command, with the shared -output, -config and -secrets-dir flags
+func (c *CLI) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.Out)
+	flags.StringVar(&c.Output, "output", c.Output, "Output format, text or json")
+	flags.String(configFileFlag, "", "YAML, TOML or JSON config file, overrides "+configFileEnv)
+	flags.String(secretsDirFlag, "", "Directory of secret files e.g. /run/secrets, overrides "+secretsDirEnv)
+	c.commandFlags = flags
+	return flags
+}
+
+// Like flags, plus a flag for every setting as taken by serve e.g. -db-conn-string, for commands that connect to the DB
+func (c *CLI) dbFlags(name string) *flag.FlagSet {
+	flags := c.flags(name)
+	config.RegisterFlags(flags, &Options{})
+	return flags
+}
+
+// Parses flags wherever they appear among the positional args, returning the positional args
+func (c *CLI) parse(flags *flag.FlagSet, args []string, positional int) ([]string, error) {
+	var values []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		values = append(values, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(values) != positional {
+		return nil, fmt.Errorf("%s expects %d argument(s) but got %d", flags.Name(), positional, len(values))
+	}
+	if c.Output != "text" && c.Output != "json" {
+		return nil, fmt.Errorf("-output must be text or json")
+	}
+	return values, nil
+}
+
+// Writes value as JSON, or rows as an aligned table for text output
+func (c *CLI) print(value interface{}, header []string, rows [][]string) error {
+	if c.Output == "json" {
+		encoder := json.NewEncoder(c.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+
+	w := tabwriter.NewWriter(c.Out, 0, 4, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// Writes a confirmation, as {"message": ...} for JSON output
+func (c *CLI) printMessage(message string) error {
+	return c.print(map[string]string{"message": message}, nil, [][]string{{message}})
+}
+
+func serveCommand(c *CLI, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(c.Out)
+	RegisterOptionFlags(flags)
+	if _, err := c.parse(flags, args, 0); err != nil {
+		return err
+	}
+	return Start(flags)
+}
+
+// Prints the effective config and where each setting came from, then reports anything that would stop the API from starting
+func printConfigCommand(c *CLI, args []string) error {
+	flags := c.flags("config print")
+	config.RegisterFlags(flags, &Options{})
+	if _, err := c.parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	options, sources, configErrors := loadAppOptions(flags)
+	settings := config.Settings(options, sources)
+	rows := make([][]string, len(settings))
+	for i, setting := range settings {
+		rows[i] = []string{setting.Env, setting.Value, string(setting.Source)}
+	}
+	if err := c.print(settings, []string{"SETTING", "VALUE", "SOURCE"}, rows); err != nil {
+		return err
+	}
+
+	if err := options.validateDB(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if err := options.validateServe(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if configErrors != nil {
+		return errors.New("invalid config - " + configErrors.Error())
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/controllers"
+	"github.com/conormkelly/fiber-demo/migrations"
+	"github.com/conormkelly/fiber-demo/models"
+	"github.com/conormkelly/fiber-demo/services"
+	"github.com/conormkelly/fiber-demo/validation"
+)
+
+func migrateCommand(operation string) func(c *CLI, args []string) error {
+	return func(c *CLI, args []string) error {
+		if _, err := c.parse(c.dbFlags("migrate "+operation), args, 0); err != nil {
+			return err
+		}
+
+		app, err := c.Connect(c.commandFlags)
+		if err != nil {
+			return err
+		}
+		defer app.DB.Close()
+		migrator, err := migrations.New(app.DB.Conn)
+		if err != nil {
+			return err
+		}
+
+		switch operation {
+		case "status":
+			statuses, err := migrator.Status()
+			if err != nil {
+				return err
+			}
+			return c.printMigrations(statuses)
+		case "up":
+			applied, err := migrator.Up()
+			statuses := make([]migrations.Status, len(applied))
+			for i, migration := range applied {
+				statuses[i] = migrations.Status{Migration: migration}
+			}
+			if printErr := c.printMigrations(statuses); printErr != nil || err != nil {
+				return firstError(err, printErr)
+			}
+		case "down", "redo":
+			rollback := migrator.Down
+			if operation == "redo" {
+				rollback = migrator.Redo
+			}
+			migration, err := rollback()
+			if err != nil {
+				return err
+			}
+			var statuses []migrations.Status
+			if migration != nil {
+				statuses = append(statuses, migrations.Status{Migration: *migration})
+			}
+			return c.printMigrations(statuses)
+		}
+		return nil
+	}
+}
+
+type migrationOutput struct {
+	Version   uint64     `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+func (c *CLI) printMigrations(statuses []migrations.Status) error {
+	output := make([]migrationOutput, len(statuses))
+	rows := make([][]string, len(statuses))
+	for i, status := range statuses {
+		output[i] = migrationOutput{Version: status.Version, Name: status.Name, AppliedAt: status.AppliedAt}
+		appliedAt := "pending"
+		if status.AppliedAt != nil {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		rows[i] = []string{strconv.FormatUint(status.Version, 10), status.Name, appliedAt}
+	}
+	return c.print(output, []string{"VERSION", "NAME", "APPLIED_AT"}, rows)
+}
+
+// Creates every user in a JSON file such as [{"first_name": "John", "last_name": "Doe"}],
+// validating them all before any are created
+func seedCommand(c *CLI, args []string) error {
+	flags := c.dbFlags("seed")
+	file := flags.String("file", "", "JSON file of users to create")
+	if _, err := c.parse(flags, args, 0); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("seed requires -file")
+	}
+
+	contents, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	var requests []controllers.CreateUserRequest
+	if err := json.Unmarshal(contents, &requests); err != nil {
+		return fmt.Errorf("invalid seed file %s: %w", *file, err)
+	}
+	for i := range requests {
+		if err := validation.Struct(&requests[i]); err != nil {
+			return fmt.Errorf("user %d in %s: %w", i+1, *file, describeError(err))
+		}
+	}
+
+	svc, err := c.userService()
+	if err != nil {
+		return err
+	}
+	defer svc.DB.Close()
+	var users []models.User
+	for _, request := range requests {
+		user, err := svc.CreateUser(context.Background(), request.FirstName, request.LastName)
+		if err != nil {
+			return err
+		}
+		users = append(users, *user)
+	}
+	return c.printUsers(users)
+}
+
+func listUsersCommand(c *CLI, args []string) error {
+	flags := c.dbFlags("users list")
+	query := &services.UserQuery{}
+	flags.IntVar(&query.Limit, "limit", services.DefaultUserLimit, fmt.Sprintf("Number of users to list, at most %d", services.MaxUserLimit))
+	flags.IntVar(&query.Offset, "offset", 0, "Number of users to skip")
+	flags.BoolVar(&query.IncludeDeleted, "include-deleted", false, "Include soft deleted users")
+	sort := flags.String("sort", "", "Comma separated fields, prefixed with - for descending e.g. -created_at")
+	if _, err := c.parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	if query.Limit < 1 || query.Limit > services.MaxUserLimit {
+		return fmt.Errorf("-limit must be between 1 and %d", services.MaxUserLimit)
+	}
+	var err error
+	if query.Sort, err = services.ParseUserSort(*sort); err != nil {
+		return err
+	}
+
+	svc, err := c.userService()
+	if err != nil {
+		return err
+	}
+	defer svc.DB.Close()
+	users, _, err := svc.GetAllUsers(context.Background(), query)
+	if err != nil {
+		return err
+	}
+	return c.printUsers(users)
+}
+
+func getUserCommand(c *CLI, args []string) error {
+	id, err := c.parseID(c.dbFlags("users get"), args)
+	if err != nil {
+		return err
+	}
+
+	svc, err := c.userService()
+	if err != nil {
+		return err
+	}
+	defer svc.DB.Close()
+	user, err := svc.GetUser(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	return c.printUsers([]models.User{*user})
+}
+
+func createUserCommand(c *CLI, args []string) error {
+	flags := c.dbFlags("users create")
+	request := &controllers.CreateUserRequest{}
+	flags.StringVar(&request.FirstName, "first-name", "", "First name")
+	flags.StringVar(&request.LastName, "last-name", "", "Last name")
+	if _, err := c.parse(flags, args, 0); err != nil {
+		return err
+	}
+	if err := validation.Struct(request); err != nil {
+		return describeError(err)
+	}
+
+	svc, err := c.userService()
+	if err != nil {
+		return err
+	}
+	defer svc.DB.Close()
+	user, err := svc.CreateUser(context.Background(), request.FirstName, request.LastName)
+	if err != nil {
+		return err
+	}
+	return c.printUsers([]models.User{*user})
+}
+
+// Changes only the names that are passed, like a PATCH
+func updateUserCommand(c *CLI, args []string) error {
+	flags := c.dbFlags("users update")
+	firstName := flags.String("first-name", "", "New first name")
+	lastName := flags.String("last-name", "", "New last name")
+	id, err := c.parseID(flags, args)
+	if err != nil {
+		return err
+	}
+
+	svc, err := c.userService()
+	if err != nil {
+		return err
+	}
+	defer svc.DB.Close()
+	user, err := svc.GetUser(context.Background(), id)
+	if err != nil {
+		return err
+	}
+
+	request := &controllers.ReplaceUserRequest{FirstName: user.FirstName, LastName: user.LastName}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "first-name":
+			request.FirstName = *firstName
+		case "last-name":
+			request.LastName = *lastName
+		}
+	})
+	if err := validation.Struct(request); err != nil {
+		return describeError(err)
+	}
+
+	// Only save over the version that the change was based on
+	precondition := &services.Precondition{Versions: []uint{user.Version}}
+	user, err = svc.UpdateUser(context.Background(), id, &request.FirstName, &request.LastName, precondition)
+	if err != nil {
+		return err
+	}
+	return c.printUsers([]models.User{*user})
+}
+
+func deleteUserCommand(c *CLI, args []string) error {
+	flags := c.dbFlags("users delete")
+	hard := flags.Bool("hard", false, "Purge the user rather than soft deleting it")
+	id, err := c.parseID(flags, args)
+	if err != nil {
+		return err
+	}
+
+	svc, err := c.userService()
+	if err != nil {
+		return err
+	}
+	defer svc.DB.Close()
+	if *hard {
+		if err := svc.PurgeUser(context.Background(), id, nil); err != nil {
+			return err
+		}
+		return c.printMessage("Successfully purged user")
+	}
+	if err := svc.DeleteUser(context.Background(), id, nil); err != nil {
+		return err
+	}
+	return c.printMessage("Successfully deleted user")
+}
+
+// Connects a service to the DB, which the caller must close
+func (c *CLI) userService() (*services.UserService, error) {
+	app, err := c.Connect(c.commandFlags)
+	if err != nil {
+		return nil, err
+	}
+	return &services.UserService{DB: app.DB, CursorSecret: []byte(app.Options.CursorSecret.Value())}, nil
+}
+
+func (c *CLI) parseID(flags *flag.FlagSet, args []string) (int, error) {
+	values, err := c.parse(flags, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0, fmt.Errorf("User ID must be an integer")
+	}
+	return id, nil
+}
+
+// Prints users as serialized by the API
+func (c *CLI) printUsers(users []models.User) error {
+	serializedUsers := make([]controllers.User, len(users))
+	rows := make([][]string, len(users))
+	for i, user := range users {
+		serializedUsers[i] = controllers.Serialize(user)
+		deletedAt := "-"
+		if user.DeletedAt.Valid {
+			deletedAt = user.DeletedAt.Time.Format(time.RFC3339)
+		}
+		rows[i] = []string{strconv.FormatUint(uint64(user.ID), 10), user.FirstName, user.LastName, deletedAt}
+	}
+	return c.print(serializedUsers, []string{"ID", "FIRST_NAME", "LAST_NAME", "DELETED_AT"}, rows)
+}
+
+// Spells out which fields failed validation, as the error handler would in a 422 response
+func describeError(err error) error {
+	validationErr, ok := err.(*validation.Error)
+	if !ok {
+		return err
+	}
+	message := validationErr.Error()
+	for _, field := range validationErr.Fields {
+		message += fmt.Sprintf("; %s %s", field.Field, field.Message)
+	}
+	return fmt.Errorf("%s", message)
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+// Package config loads settings into a struct from, in increasing order of precedence:
+// the values it already holds (its defaults), a YAML, TOML or JSON file, a secrets directory, environment variables and flags.
+//
+// Each field is named by its `config` tag, e.g. `config:"jwt.keys_refresh"`, which is its path in the file
+// (jwt: {keys_refresh: 30s}), its environment variable (APP_JWT_KEYS_REFRESH) and its flag (-jwt-keys-refresh).
+// Any environment variable can instead name a file holding the value, e.g. APP_JWT_SECRET_FILE=/run/secrets/jwt.
+//
+// Supported field types are string, Secret, bool, int, float64, time.Duration and map[string]string.
+// Secrets are redacted by Settings, and are also read from files in the secrets directory named after
+// their environment variable without the prefix, e.g. <dir>/jwt_secret.
+// Maps are read from a table in the file, and their entries from the environment e.g. APP_CACHE_CONTROL_USERS_GET,
+// but only for keys that are already present, as environment variable names can't be mapped back to keys.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+const EnvPrefix = "APP_"
+
+// Where a setting's value came from
+type Source string
+
+const (
+	Default    Source = "default"
+	File       Source = "file"
+	SecretsDir Source = "secrets_dir"
+	Env        Source = "env"
+	EnvFile    Source = "env_file" // Read from the file named by a *_FILE environment variable
+	Flag       Source = "flag"
+)
+
+// Suffix of the environment variables that name a file holding the value
+const FileSuffix = "_FILE"
+
+// Where settings are loaded from, besides the defaults and environment. Every layer is optional.
+type Layers struct {
+	File       string        // YAML, TOML or JSON config file
+	SecretsDir string        // Directory of files holding secrets e.g. /run/secrets
+	Flags      *flag.FlagSet // Set up with RegisterFlags and parsed
+}
+
+// A loaded setting, as it should be displayed
+type Setting struct {
+	Key    string `json:"key"`
+	Env    string `json:"env"`
+	Value  string `json:"value"`
+	Source Source `json:"source"`
+}
+
+// Where each setting's value came from, keyed by setting
+type Sources map[string]Source
+
+type field struct {
+	key   string
+	value reflect.Value
+}
+
+func (f field) secret() bool {
+	return f.value.Type() == reflect.TypeOf(Secret(""))
+}
+
+// Name of the file holding a secret in the secrets directory e.g. db_conn_string
+func SecretFileName(key string) string {
+	return strings.ToLower(strings.TrimPrefix(EnvName(key), EnvPrefix))
+}
+
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+func FlagName(key string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(key)
+}
+
+// Registers a flag for every setting of target, except maps.
+// Flags default to empty, as only those that are passed override the other layers.
+func RegisterFlags(flags *flag.FlagSet, target interface{}) {
+	for _, f := range fields(target) {
+		if f.value.Kind() != reflect.Map {
+			flags.String(FlagName(f.key), "", fmt.Sprintf("Overrides %s", EnvName(f.key)))
+		}
+	}
+}
+
+// Loads every layer into target, which must be a pointer to a struct holding the defaults.
+// Every invalid value is reported, rather than just the first.
+func Load(target interface{}, layers Layers) (Sources, error) {
+	sources := Sources{}
+	var configErrors error
+	fieldList := fields(target)
+	for _, f := range fieldList {
+		sources[f.key] = Default
+	}
+
+	if file := layers.File; file != "" {
+		values, err := readFile(file)
+		if err != nil {
+			return sources, err
+		}
+		if err := checkKeys(values, fieldList, file); err != nil {
+			configErrors = multierror.Append(configErrors, err)
+		}
+		for _, f := range fieldList {
+			value, ok := lookup(values, f.key)
+			if !ok {
+				continue
+			}
+			name := fmt.Sprintf("%s in %s", f.key, filepath.Base(file))
+			if err := setFromFile(f.value, value, name); err != nil {
+				configErrors = multierror.Append(configErrors, err)
+				continue
+			}
+			sources[f.key] = File
+		}
+	}
+
+	if layers.SecretsDir != "" {
+		for _, f := range fieldList {
+			if !f.secret() {
+				continue
+			}
+			path := filepath.Join(layers.SecretsDir, SecretFileName(f.key))
+			raw, err := readValueFile(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err == nil {
+				err = set(f.value, raw, path)
+			}
+			if err != nil {
+				configErrors = multierror.Append(configErrors, err)
+				continue
+			}
+			sources[f.key] = SecretsDir
+		}
+	}
+
+	for _, f := range fieldList {
+		if f.value.Kind() == reflect.Map {
+			for _, mapKey := range f.value.MapKeys() {
+				name := EnvName(f.key + "_" + mapKey.String())
+				if raw, ok := os.LookupEnv(name); ok {
+					f.value.SetMapIndex(mapKey, reflect.ValueOf(raw))
+					sources[f.key] = Env
+				}
+			}
+			continue
+		}
+		// Empty variables are treated as unset, as they often come from templates with missing values
+		name, fileName := EnvName(f.key), EnvName(f.key)+FileSuffix
+		raw, path := os.Getenv(name), os.Getenv(fileName)
+		if raw != "" && path != "" {
+			configErrors = multierror.Append(configErrors, fmt.Errorf("only one of %s and %s may be set", name, fileName))
+			continue
+		}
+		source := Env
+		if path != "" {
+			var err error
+			if raw, err = readValueFile(path); err != nil {
+				configErrors = multierror.Append(configErrors, fmt.Errorf("%s could not be read - %w", fileName, err))
+				continue
+			}
+			name, source = fileName, EnvFile
+		}
+		if raw != "" {
+			if err := set(f.value, raw, name); err != nil {
+				configErrors = multierror.Append(configErrors, err)
+				continue
+			}
+			sources[f.key] = source
+		}
+	}
+
+	if flags := layers.Flags; flags != nil {
+		for _, f := range fieldList {
+			name := FlagName(f.key)
+			flags.Visit(func(passed *flag.Flag) {
+				if passed.Name != name {
+					return
+				}
+				if err := set(f.value, passed.Value.String(), "-"+name); err != nil {
+					configErrors = multierror.Append(configErrors, err)
+					return
+				}
+				sources[f.key] = Flag
+			})
+		}
+	}
+
+	return sources, configErrors
+}
+
+// Lists every setting of target with its value, with secrets redacted, ordered by key
+func Settings(target interface{}, sources Sources) []Setting {
+	var settings []Setting
+	for _, f := range fields(target) {
+		if f.value.Kind() == reflect.Map {
+			keys := f.value.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, mapKey := range keys {
+				key := f.key + "." + mapKey.String()
+				settings = append(settings, Setting{
+					Key:    key,
+					Env:    EnvName(f.key + "_" + mapKey.String()),
+					Value:  format(f.value.MapIndex(mapKey)),
+					Source: sources[f.key],
+				})
+			}
+			continue
+		}
+		settings = append(settings, Setting{Key: f.key, Env: EnvName(f.key), Value: format(f.value), Source: sources[f.key]})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+func format(value reflect.Value) string {
+	switch v := value.Interface().(type) {
+	case time.Duration:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func fields(target interface{}) []field {
+	value := reflect.ValueOf(target).Elem()
+	var result []field
+	for i := 0; i < value.NumField(); i++ {
+		structField := value.Type().Field(i)
+		key := structField.Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		result = append(result, field{key: key, value: value.Field(i)})
+	}
+	return result
+}
+
+// Parses a raw value into a field, naming the source of the value in any error
+func set(value reflect.Value, raw, name string) error {
+	switch value.Interface().(type) {
+	case string, Secret:
+		value.SetString(raw)
+	case bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", name)
+		}
+		value.SetBool(parsed)
+	case int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", name)
+		}
+		value.SetInt(int64(parsed))
+	case float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", name)
+		}
+		value.SetFloat(parsed)
+	case time.Duration:
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration e.g. 30s", name)
+		}
+		value.SetInt(int64(parsed))
+	default:
+		return fmt.Errorf("%s has an unsupported type %s", name, value.Type())
+	}
+	return nil
+}
+
+// Sets a field from a decoded file value, which may be a table for maps
+func setFromFile(value reflect.Value, fileValue interface{}, name string) error {
+	if value.Kind() == reflect.Map {
+		table, ok := fileValue.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a table", name)
+		}
+		if value.IsNil() {
+			value.Set(reflect.MakeMap(value.Type()))
+		}
+		for key, entry := range table {
+			value.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(fileString(entry)))
+		}
+		return nil
+	}
+	if _, ok := fileValue.(map[string]interface{}); ok {
+		return fmt.Errorf("%s must not be a table", name)
+	}
+	return set(value, fileString(fileValue), name)
+}
+
+// Formats a decoded file value the way it would be written in an environment variable.
+// Floats are written out in full, as fmt would turn a YAML 1000000.0 into "1e+06", which isn't a valid int.
+func fileString(fileValue interface{}) string {
+	if number, ok := fileValue.(float64); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return fmt.Sprint(fileValue)
+}
+
+// Reads a value from a file, ignoring the trailing newline that editors and `echo` add
+func readValueFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+func readFile(file string) (map[string]interface{}, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &values)
+	case ".toml":
+		err = toml.Unmarshal(contents, &values)
+	case ".json":
+		// Numbers are kept as written, rather than decoded to float64 and printed as e.g. "1e+06"
+		decoder := json.NewDecoder(bytes.NewReader(contents))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	default:
+		return nil, fmt.Errorf("config file %s must be .yaml, .yml, .toml or .json", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", file, err)
+	}
+	return values, nil
+}
+
+// Finds a dotted key in nested tables, also accepting keys that are written out in full e.g. "jwt.issuer: ..."
+func lookup(values map[string]interface{}, key string) (interface{}, bool) {
+	if value, ok := values[key]; ok {
+		return value, true
+	}
+	parts := strings.Split(key, ".")
+	for i := 1; i < len(parts); i++ {
+		table, ok := values[strings.Join(parts[:i], ".")].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if value, ok := lookup(table, strings.Join(parts[i:], ".")); ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Reports settings in the file that don't exist, which are most likely typos
+func checkKeys(values map[string]interface{}, fieldList []field, file string) error {
+	known := map[string]bool{}
+	tables := map[string]bool{}
+	for _, f := range fieldList {
+		known[f.key] = true
+		if f.value.Kind() == reflect.Map {
+			tables[f.key] = true
+		}
+	}
+
+	var unknown []string
+	var walk func(prefix string, table map[string]interface{})
+	walk = func(prefix string, table map[string]interface{}) {
+		for key, value := range table {
+			path := strings.TrimPrefix(prefix+"."+key, ".")
+			if known[path] {
+				continue
+			}
+			if nested, ok := value.(map[string]interface{}); ok && !tables[path] {
+				walk(path, nested)
+				continue
+			}
+			unknown = append(unknown, path)
+		}
+	}
+	walk("", values)
+
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return errors.New("unknown settings in " + filepath.Base(file) + ": " + strings.Join(unknown, ", "))
+}
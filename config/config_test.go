@@ -0,0 +1,190 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSettings struct {
+	Name    string            `config:"name"`
+	Secret  Secret            `config:"db.password"`
+	Enabled bool              `config:"enabled"`
+	Retries int               `config:"retries"`
+	Timeout time.Duration     `config:"http.timeout"`
+	Ratio   float64           `config:"ratio"`
+	Headers map[string]string `config:"headers"`
+	Ignored string
+}
+
+func defaults() *testSettings {
+	return &testSettings{Name: "default", Retries: 3, Timeout: time.Second, Headers: map[string]string{"accept": "*/*"}}
+}
+
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFiles(t *testing.T) {
+	testCases := []struct {
+		file     string
+		contents string
+	}{
+		{"settings.yaml", "name: file\nenabled: true\nhttp:\n  timeout: 5s\nheaders:\n  accept: text/plain\n"},
+		{"settings.yml", "name: file\nenabled: true\nhttp.timeout: 5s\nheaders:\n  accept: text/plain\n"},
+		{"settings.toml", "name = \"file\"\nenabled = true\n[http]\ntimeout = \"5s\"\n[headers]\naccept = \"text/plain\"\n"},
+		{"settings.json", `{"name": "file", "enabled": true, "http": {"timeout": "5s"}, "headers": {"accept": "text/plain"}}`},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprintf("%s - %s", t.Name(), test.file), func(t *testing.T) {
+			settings := defaults()
+			sources, err := Load(settings, Layers{File: writeFile(t, test.file, test.contents)})
+
+			assert.Nil(t, err)
+			assert.Equal(t, "file", settings.Name)
+			assert.True(t, settings.Enabled)
+			assert.Equal(t, 5*time.Second, settings.Timeout)
+			assert.Equal(t, 3, settings.Retries, "settings missing from the file keep their defaults")
+			assert.Equal(t, "text/plain", settings.Headers["accept"])
+			assert.Equal(t, Sources{"name": File, "db.password": Default, "enabled": File, "retries": Default, "http.timeout": File, "ratio": Default, "headers": File}, sources)
+		})
+	}
+}
+
+// Large numbers aren't turned into exponents on their way from the file to the field
+func TestLoadLargeNumbers(t *testing.T) {
+	for file, contents := range map[string]string{
+		"settings.json": `{"retries": 1000000, "ratio": 1000000.5, "headers": {"x-max": 10000000}}`,
+		"settings.yaml": "retries: 1000000\nratio: 1000000.5\nheaders:\n  x-max: 10000000.0\n",
+	} {
+		settings := defaults()
+		_, err := Load(settings, Layers{File: writeFile(t, file, contents)})
+
+		assert.Nil(t, err, file)
+		assert.Equal(t, 1000000, settings.Retries, file)
+		assert.Equal(t, 1000000.5, settings.Ratio, file)
+		assert.Equal(t, "10000000", settings.Headers["x-max"], file)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "settings.yaml", "name: file\nretries: 5\nenabled: true\n")
+	t.Setenv("APP_NAME", "env")
+	t.Setenv("APP_RETRIES", "7")
+	t.Setenv("APP_RATIO", "0.25")
+	t.Setenv("APP_ENABLED", "")
+	t.Setenv("APP_HEADERS_ACCEPT", "application/json")
+	t.Setenv("APP_HEADERS_USER_AGENT", "ignored")
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(flags, &testSettings{})
+	assert.Nil(t, flags.Parse([]string{"-retries", "9"}))
+
+	settings := defaults()
+	sources, err := Load(settings, Layers{File: file, Flags: flags})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "env", settings.Name, "env overrides the file")
+	assert.Equal(t, 9, settings.Retries, "flags override env")
+	assert.Equal(t, 0.25, settings.Ratio)
+	assert.True(t, settings.Enabled, "empty env vars are ignored")
+	assert.Equal(t, map[string]string{"accept": "application/json"}, settings.Headers, "only existing map entries are read from env")
+	assert.Equal(t, Env, sources["name"])
+	assert.Equal(t, Flag, sources["retries"])
+	assert.Equal(t, File, sources["enabled"])
+	assert.Nil(t, flags.Lookup("headers"), "maps have no flag")
+}
+
+func TestLoadErrors(t *testing.T) {
+	file := writeFile(t, "settings.json", `{"name": "file", "enabled": "maybe", "http": {"timeout": "5s", "retries": 1}, "nmae": "typo"}`)
+	t.Setenv("APP_RETRIES", "three")
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(flags, &testSettings{})
+	assert.Nil(t, flags.Parse([]string{"-http-timeout", "soon"}))
+
+	settings := defaults()
+	_, err := Load(settings, Layers{File: file, Flags: flags})
+
+	assert.Equal(t, `4 errors occurred:
+	* unknown settings in settings.json: http.retries, nmae
+	* enabled in settings.json must be true or false
+	* APP_RETRIES must be an integer
+	* -http-timeout must be a duration e.g. 30s
+
+`, err.Error())
+	assert.Equal(t, "file", settings.Name, "valid settings are still loaded")
+
+	ini := writeFile(t, "settings.ini", "name=file")
+	_, err = Load(defaults(), Layers{File: ini})
+	assert.EqualError(t, err, "config file "+ini+" must be .yaml, .yml, .toml or .json")
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	secretsDir := t.TempDir()
+	os.WriteFile(filepath.Join(secretsDir, "db_password"), []byte("from-dir\n"), 0600)
+	os.WriteFile(filepath.Join(secretsDir, "name"), []byte("not-a-secret"), 0600)
+
+	settings := defaults()
+	sources, err := Load(settings, Layers{SecretsDir: secretsDir})
+	assert.Nil(t, err)
+	assert.Equal(t, Secret("from-dir"), settings.Secret, "the trailing newline is trimmed")
+	assert.Equal(t, SecretsDir, sources["db.password"])
+	assert.Equal(t, "default", settings.Name, "only secrets are read from the secrets dir")
+
+	t.Setenv("APP_DB_PASSWORD_FILE", writeFile(t, "password", "from-env-file\r\n"))
+	t.Setenv("APP_RETRIES_FILE", writeFile(t, "retries", "5"))
+	settings = defaults()
+	sources, err = Load(settings, Layers{SecretsDir: secretsDir})
+	assert.Nil(t, err)
+	assert.Equal(t, Secret("from-env-file"), settings.Secret, "*_FILE variables override the secrets dir")
+	assert.Equal(t, 5, settings.Retries, "any setting can be read from a *_FILE variable")
+	assert.Equal(t, EnvFile, sources["db.password"])
+
+	t.Setenv("APP_DB_PASSWORD", "from-env")
+	t.Setenv("APP_RETRIES_FILE", filepath.Join(secretsDir, "missing"))
+	_, err = Load(defaults(), Layers{})
+	assert.Equal(t, `2 errors occurred:
+	* only one of APP_DB_PASSWORD and APP_DB_PASSWORD_FILE may be set
+	* APP_RETRIES_FILE could not be read - open `+filepath.Join(secretsDir, "missing")+`: no such file or directory
+
+`, err.Error())
+}
+
+func TestSecret(t *testing.T) {
+	secret := Secret("hunter2")
+	for _, text := range []string{fmt.Sprint(secret), fmt.Sprintf("%v %s %q %#v %+v", secret, secret, secret, secret, struct{ S Secret }{secret})} {
+		assert.NotContains(t, text, "hunter2")
+	}
+	encoded, _ := json.Marshal(map[string]Secret{"password": secret})
+	assert.Equal(t, `{"password":"(redacted)"}`, string(encoded))
+	assert.Equal(t, "hunter2", secret.Value())
+	assert.Equal(t, "", Secret("").String(), "empty secrets aren't shown as set")
+}
+
+func TestSettings(t *testing.T) {
+	settings := defaults()
+	settings.Secret = "hunter2"
+	sources := Sources{"name": Default, "db.password": Env, "enabled": Default, "retries": Flag, "http.timeout": Default, "ratio": Default, "headers": File}
+
+	assert.Equal(t, []Setting{
+		{Key: "db.password", Env: "APP_DB_PASSWORD", Value: "(redacted)", Source: Env},
+		{Key: "enabled", Env: "APP_ENABLED", Value: "false", Source: Default},
+		{Key: "headers.accept", Env: "APP_HEADERS_ACCEPT", Value: "*/*", Source: File},
+		{Key: "http.timeout", Env: "APP_HTTP_TIMEOUT", Value: "1s", Source: Default},
+		{Key: "name", Env: "APP_NAME", Value: "default", Source: Default},
+		{Key: "ratio", Env: "APP_RATIO", Value: "0", Source: Default},
+		{Key: "retries", Env: "APP_RETRIES", Value: "3", Source: Flag},
+	}, Settings(settings, sources))
+}
@@ -0,0 +1,33 @@
+package config
+
+import "log/slog"
+
+const redacted = "(redacted)"
+
+// A setting that must never be printed, such as a password.
+// It formats, and marshals to JSON or YAML, as "(redacted)" unless it is empty. Value returns the real value.
+type Secret string
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return `config.Secret("` + s.String() + `")`
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Keeps secrets out of structured logs
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
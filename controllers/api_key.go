@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/auth"
+	"github.com/conormkelly/fiber-demo/models"
+	"github.com/conormkelly/fiber-demo/services"
+	"github.com/conormkelly/fiber-demo/validation"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Serializer for models.APIKey. Key is only set in the response to creating it.
+type APIKey struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	CreatedBy  string     `json:"created_by"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func SerializeAPIKey(apiKey models.APIKey) APIKey {
+	return APIKey{
+		ID:         apiKey.ID,
+		Name:       apiKey.Name,
+		Prefix:     apiKey.Prefix,
+		Scopes:     apiKey.Scopes,
+		CreatedAt:  apiKey.CreatedAt,
+		CreatedBy:  apiKey.CreatedBy,
+		ExpiresAt:  apiKey.ExpiresAt,
+		LastUsedAt: apiKey.LastUsedAt,
+	}
+}
+
+type APIKeyList struct {
+	Data []APIKey `json:"data"`
+}
+
+type APIKeysController struct {
+	Service *services.APIKeyService
+	Policy  auth.Policy
+	Logger  *slog.Logger // Defaults to slog.Default()
+}
+
+func (c *APIKeysController) CreateKey(ctx *fiber.Ctx) error {
+	if err := authorize(ctx, c.Policy, c.Logger, auth.CreateKey, 0); err != nil {
+		return err
+	}
+
+	request := &CreateAPIKeyRequest{}
+	if err := ParseBody(ctx, request); err != nil {
+		return err
+	}
+
+	// Scopes are the actions of the policy
+	var unknownScopes []validation.FieldError
+	for _, scope := range request.Scopes {
+		if _, ok := c.Policy[scope]; !ok {
+			unknownScopes = append(unknownScopes, validation.FieldError{Field: "scopes", Rule: "scope", Param: scope, Message: "is not a known action"})
+		}
+	}
+	if len(unknownScopes) > 0 {
+		return &validation.Error{Fields: unknownScopes}
+	}
+
+	createdBy := ""
+	if claims := auth.ClaimsFrom(ctx); claims != nil {
+		createdBy = claims.Subject
+
+		// A key can only grant what it holds, or one allowed to create keys could grant itself every action
+		if claims.Scopes != nil {
+			for _, scope := range request.Scopes {
+				if !claims.HasScope(scope) {
+					loggerOrDefault(c.Logger).InfoContext(ctx.UserContext(), "Denied action.", "action", auth.CreateKey, "path", ctx.Path(), "reason", fmt.Sprintf("%s can't grant %s, which is not in its scopes", claims.Subject, scope))
+					return apperrors.New(apperrors.Forbidden, "an API key can only grant the scopes it holds")
+				}
+			}
+		}
+	}
+
+	apiKey, key, err := c.Service.CreateKey(ctx.UserContext(), request.Name, request.Scopes, request.ExpiresAt, createdBy)
+	if err != nil {
+		loggerOrDefault(c.Logger).ErrorContext(ctx.UserContext(), "Error occurred in svc.CreateKey", "error", err)
+		return err
+	}
+
+	serializedKey := SerializeAPIKey(*apiKey)
+	serializedKey.Key = key
+	return ctx.Status(200).JSON(serializedKey)
+}
+
+func (c *APIKeysController) GetAllKeys(ctx *fiber.Ctx) error {
+	if err := authorize(ctx, c.Policy, c.Logger, auth.ListKeys, 0); err != nil {
+		return err
+	}
+
+	apiKeys, err := c.Service.GetAllKeys(ctx.UserContext())
+	if err != nil {
+		loggerOrDefault(c.Logger).ErrorContext(ctx.UserContext(), "Error occurred in svc.GetAllKeys", "error", err)
+		return err
+	}
+
+	serializedKeys := make([]APIKey, len(apiKeys))
+	for i, apiKey := range apiKeys {
+		serializedKeys[i] = SerializeAPIKey(apiKey)
+	}
+	return ctx.Status(200).JSON(APIKeyList{Data: serializedKeys})
+}
+
+func (c *APIKeysController) DeleteKey(ctx *fiber.Ctx) error {
+	id, err := ctx.ParamsInt("id")
+	if err != nil {
+		return apperrors.New(apperrors.InvalidID, "API key ID must be an integer")
+	}
+
+	if err := authorize(ctx, c.Policy, c.Logger, auth.DeleteKey, 0); err != nil {
+		return err
+	}
+
+	err = c.Service.DeleteKey(ctx.UserContext(), id)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(APIResponse{Message: "Successfully deleted API key"})
+}
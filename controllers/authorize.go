@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"log/slog"
+	"strconv"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/auth"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Checks the caller against the controller's policy before the service is called.
+// ownerID is the ID of the user being acted on, or 0 for actions that don't target a single user.
+func (c *UsersController) authorize(ctx *fiber.Ctx, action string, ownerID int) error {
+	return authorize(ctx, c.Policy, c.Logger, action, ownerID)
+}
+
+func authorize(ctx *fiber.Ctx, policy auth.Policy, logger *slog.Logger, action string, ownerID int) error {
+	owner := ""
+	if ownerID > 0 {
+		owner = strconv.Itoa(ownerID)
+	}
+
+	allowed, reason := policy.Authorize(auth.ClaimsFrom(ctx), action, owner)
+	if !allowed {
+		// The reason is only logged, as it describes the policy
+		loggerOrDefault(logger).InfoContext(ctx.UserContext(), "Denied action.", "action", action, "path", ctx.Path(), "reason", reason)
+		return apperrors.New(apperrors.Forbidden, "you are not allowed to perform this action")
+	}
+	return nil
+}
+
+// Only lets the request through if the caller may perform the action, for routes that don't have a controller
+func Authorize(policy auth.Policy, logger *slog.Logger, action string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if err := authorize(ctx, policy, logger, action, 0); err != nil {
+			return err
+		}
+		return ctx.Next()
+	}
+}
+
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/models"
+	"github.com/conormkelly/fiber-demo/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Strong entity tag for a single user, which changes whenever its version does
+func UserETag(user *models.User) string {
+	return fmt.Sprintf(`"%d"`, user.Version)
+}
+
+// When the user was last written, falling back to its creation for rows that pre-date UpdatedAt
+func UserLastModified(user *models.User) time.Time {
+	if user.UpdatedAt.IsZero() {
+		return user.CreatedAt
+	}
+	return user.UpdatedAt
+}
+
+// Weak entity tag for a collection of users, which changes whenever a matching user is added, removed or written
+func UsersETag(stamp *services.UsersStamp) string {
+	return fmt.Sprintf(`W/"%d-%d"`, stamp.Count, stamp.LastUpdated.UnixNano())
+}
+
+// Sets the validators a client can later send back to make a conditional GET
+func SetValidators(ctx *fiber.Ctx, etag string, lastModified time.Time) {
+	ctx.Set(fiber.HeaderETag, etag)
+	if !lastModified.IsZero() {
+		ctx.Set(fiber.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Reports whether the client's cached copy, identified by If-None-Match or If-Modified-Since, is still current.
+// If-None-Match uses a weak comparison, and takes precedence over If-Modified-Since when both are sent.
+func NotModified(ctx *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if noneMatch := ctx.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		for _, tag := range strings.Split(noneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if modifiedSince := ctx.Get(fiber.HeaderIfModifiedSince); modifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(modifiedSince)
+		// HTTP dates only have second precision
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// Parses the If-Match header into the versions a write is conditional on.
+// Returns nil when the header is absent or "*", as any existing user then matches.
+func ParseIfMatch(ctx *fiber.Ctx) *services.Precondition {
+	header := strings.TrimSpace(ctx.Get(fiber.HeaderIfMatch))
+	if header == "" || header == "*" {
+		return nil
+	}
+
+	// A header listing only unrecognised or weak tags yields an empty precondition, which nothing matches
+	precondition := &services.Precondition{Versions: []uint{}}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		// Weak tags never match, as If-Match requires a strong comparison
+		if len(tag) < 2 || !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) {
+			continue
+		}
+		version, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 0)
+		if err == nil {
+			precondition.Versions = append(precondition.Versions, uint(version))
+		}
+	}
+	return precondition
+}
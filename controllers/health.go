@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"github.com/conormkelly/fiber-demo/health"
+	"github.com/gofiber/fiber/v2"
+)
+
+type HealthController struct {
+	Checker *health.Checker
+}
+
+type HealthStatus struct {
+	Status string `json:"status"`
+}
+
+// Reports that the process is up and serving requests, without checking any dependencies
+func (c *HealthController) Liveness(ctx *fiber.Ctx) error {
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(200).JSON(HealthStatus{Status: health.StatusOK})
+}
+
+// Responds with 503 if any check fails or the app is shutting down, so that it is taken out of rotation
+func (c *HealthController) Readiness(ctx *fiber.Ctx) error {
+	report := c.Checker.Run(ctx.UserContext())
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(reportStatusCode(report)).JSON(HealthStatus{Status: report.Status})
+}
+
+// Like Readiness, but with the result and latency of each check. Their errors are only logged.
+func (c *HealthController) Health(ctx *fiber.Ctx) error {
+	report := c.Checker.Run(ctx.UserContext())
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(reportStatusCode(report)).JSON(report)
+}
+
+func reportStatusCode(report health.Report) int {
+	if report.Status != health.StatusOK {
+		return fiber.StatusServiceUnavailable
+	}
+	return fiber.StatusOK
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+type Links struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// A single page of serialized users
+type UserList struct {
+	Data   []User `json:"data"`
+	Total  int64  `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Links  Links  `json:"links"`
+}
+
+// A single page of serialized users when paginating by cursor
+type UserCursorList struct {
+	Data       []User `json:"data"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Links      Links  `json:"links"`
+}
+
+// Builds a UserQuery from the query string, e.g.
+// ?limit=10&offset=20&last_name=Doe&created_after=2022-01-01T00:00:00Z&sort=-created_at,last_name&include_deleted=true
+func ParseUserQuery(ctx *fiber.Ctx) (*services.UserQuery, error) {
+	query := &services.UserQuery{
+		Limit:     services.DefaultUserLimit,
+		FirstName: ctx.Query("first_name"),
+		LastName:  ctx.Query("last_name"),
+	}
+
+	if limit := ctx.Query("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > services.MaxUserLimit {
+			return nil, fmt.Errorf("limit must be an integer between 1 and %d", services.MaxUserLimit)
+		}
+		query.Limit = value
+	}
+
+	if offset := ctx.Query("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("offset must be a non-negative integer")
+		}
+		query.Offset = value
+	}
+
+	var err error
+	if query.IncludeDeleted, err = parseBoolQuery(ctx, "include_deleted"); err != nil {
+		return nil, err
+	}
+	if query.CreatedAfter, err = parseTimeQuery(ctx, "created_after"); err != nil {
+		return nil, err
+	}
+	if query.CreatedBefore, err = parseTimeQuery(ctx, "created_before"); err != nil {
+		return nil, err
+	}
+
+	if query.Sort, err = services.ParseUserSort(ctx.Query("sort")); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+func parseTimeQuery(ctx *fiber.Ctx, key string) (*time.Time, error) {
+	raw := ctx.Query(key)
+	if raw == "" {
+		return nil, nil
+	}
+	value, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", key)
+	}
+	return &value, nil
+}
+
+// False if the key isn't set
+func parseBoolQuery(ctx *fiber.Ctx, key string) (bool, error) {
+	raw := ctx.Query(key)
+	if raw == "" {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", key)
+	}
+	return value, nil
+}
+
+// Returns the current request's path and query, with the offset replaced
+func pageLink(ctx *fiber.Ctx, offset int) string {
+	return linkWith(ctx, "offset", strconv.Itoa(offset))
+}
+
+// Returns the current request's path and query, with the cursor replaced
+func cursorLink(ctx *fiber.Ctx, cursor string) string {
+	return linkWith(ctx, "cursor", cursor)
+}
+
+func linkWith(ctx *fiber.Ctx, key, value string) string {
+	values, _ := url.ParseQuery(string(ctx.Request().URI().QueryString()))
+	values.Set(key, value)
+	return ctx.Path() + "?" + values.Encode()
+}
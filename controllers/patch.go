@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/validation"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	MIMEMergePatch = "application/merge-patch+json" // RFC 7396
+	MIMEJSONPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+// Applies the request body to the JSON representation of the current resource,
+// picking RFC 7396 or RFC 6902 semantics based on the Content-Type,
+// then decodes the patched document into the target and validates it just like ParseBody would.
+func ApplyPatch(ctx *fiber.Ctx, current interface{}, target interface{}) error {
+	document, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	body := ctx.Body()
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(ctx.Get(fiber.HeaderContentType), ";")[0]))
+
+	var patched []byte
+	switch contentType {
+	case MIMEMergePatch:
+		if !json.Valid(body) || !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+			return apperrors.New(apperrors.InvalidPatch, "merge patch must be a JSON object")
+		}
+		if patched, err = jsonpatch.MergePatch(document, body); err != nil {
+			return apperrors.New(apperrors.InvalidPatch, "invalid merge patch provided")
+		}
+	case MIMEJSONPatch:
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return apperrors.New(apperrors.InvalidPatch, "invalid JSON patch provided")
+		}
+		if patched, err = patch.Apply(document); err != nil {
+			// The patch was well formed, but can't be applied to the resource in its current state e.g. a failed "test"
+			if errors.Is(err, jsonpatch.ErrTestFailed) || errors.Is(err, jsonpatch.ErrMissing) {
+				return apperrors.New(apperrors.PatchConflict, "JSON patch could not be applied: "+err.Error())
+			}
+			return apperrors.New(apperrors.InvalidPatch, "invalid JSON patch provided")
+		}
+	default:
+		return apperrors.New(apperrors.UnsupportedMediaType, "PATCH requires a Content-Type of "+MIMEMergePatch+" or "+MIMEJSONPatch)
+	}
+
+	if err := decodeStrict(patched, target); err != nil {
+		return err
+	}
+	return validation.Struct(target)
+}
+
+// Decodes a patched document, reporting unknown or mistyped fields as validation errors
+func decodeStrict(document []byte, target interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(document, &fields); err != nil {
+		return apperrors.New(apperrors.ValidationFailed, "patched document must be a JSON object")
+	}
+
+	known := map[string]bool{}
+	targetType := reflect.TypeOf(target).Elem()
+	for i := 0; i < targetType.NumField(); i++ {
+		known[strings.SplitN(targetType.Field(i).Tag.Get("json"), ",", 2)[0]] = true
+	}
+
+	var fieldErrors []validation.FieldError
+	for name, value := range fields {
+		if !known[name] {
+			fieldErrors = append(fieldErrors, validation.FieldError{Field: name, Rule: "unknown", Message: "is not a recognised field"})
+			continue
+		}
+		// Explicit nulls, e.g. from a JSON patch "replace" with a null value, clear the field
+		if string(value) == "null" {
+			continue
+		}
+		single, _ := json.Marshal(map[string]json.RawMessage{name: value})
+		if err := json.Unmarshal(single, target); err != nil {
+			fieldErrors = append(fieldErrors, validation.FieldError{Field: name, Rule: "type", Message: "has the wrong type"})
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		sort.Slice(fieldErrors, func(i, j int) bool { return fieldErrors[i].Field < fieldErrors[j].Field })
+		return &validation.Error{Fields: fieldErrors}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import "time"
+
+// Request bodies accepted by the users and API keys endpoints.
+// These are kept separate from models.User so that clients can only set what they are allowed to.
+
+type CreateUserRequest struct {
+	FirstName string `json:"first_name" normalize:"trim" validate:"required,max=100,personname"`
+	LastName  string `json:"last_name" normalize:"trim" validate:"required,max=100,personname"`
+}
+
+// A full representation of the user, used by PUT and as the document that PATCH requests are applied to.
+// A missing or null last name clears it, for people who only go by one name.
+type ReplaceUserRequest struct {
+	FirstName string `json:"first_name" normalize:"trim" validate:"required,max=100,personname"`
+	LastName  string `json:"last_name" normalize:"trim" validate:"omitempty,max=100,personname"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" normalize:"trim" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1,dive,required"` // Actions the key may perform, e.g. "users:read"
+	ExpiresAt *time.Time `json:"expires_at" validate:"omitempty,gt"`
+}
@@ -1,50 +1,68 @@
 package controllers
 
 import (
-	"errors"
-	"log"
+	"log/slog"
+	"time"
 
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/auth"
 	"github.com/conormkelly/fiber-demo/models"
 	"github.com/conormkelly/fiber-demo/services"
+	"github.com/conormkelly/fiber-demo/validation"
 	"github.com/gofiber/fiber/v2"
 )
 
 type APIResponse struct {
-	Message string `json:"message"`
+	Message   string                  `json:"message"`
+	Errors    []validation.FieldError `json:"errors,omitempty"`
+	RequestID string                  `json:"request_id,omitempty"` // Set on errors, so they can be matched to the logs
 }
 
 // This is not the user model,
 // think of it as a serializer
 type User struct {
-	ID        uint   `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
+	ID        uint       `json:"id"`
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // Only present for soft deleted users
 }
 
 func Serialize(userModel models.User) User {
-	return User{ID: userModel.ID, FirstName: userModel.FirstName, LastName: userModel.LastName}
+	user := User{ID: userModel.ID, FirstName: userModel.FirstName, LastName: userModel.LastName}
+	if userModel.DeletedAt.Valid {
+		user.DeletedAt = &userModel.DeletedAt.Time
+	}
+	return user
 }
 
 type UsersController struct {
 	Service *services.UserService
+	Policy  auth.Policy  // Decides which callers may perform each action
+	Logger  *slog.Logger // Defaults to slog.Default()
 }
 
+// Parses the JSON body into the target, then normalizes and validates it based on its struct tags.
+// The returned error is either an INVALID_REQUEST *apperrors.Error or a *validation.Error, which is rendered as VALIDATION_FAILED.
 func ParseBody(ctx *fiber.Ctx, target interface{}) error {
 	if err := ctx.BodyParser(target); err != nil {
-		return errors.New("invalid JSON request body provided")
+		return apperrors.New(apperrors.InvalidRequest, "invalid JSON request body provided")
 	}
-	return nil
+	return validation.Struct(target)
 }
 
 func (c *UsersController) CreateUser(ctx *fiber.Ctx) error {
-	user := &models.User{}
-	if err := ParseBody(ctx, user); err != nil {
-		return ctx.Status(400).JSON(APIResponse{Message: err.Error()})
+	if err := c.authorize(ctx, auth.CreateUser, 0); err != nil {
+		return err
+	}
+
+	request := &CreateUserRequest{}
+	if err := ParseBody(ctx, request); err != nil {
+		return err
 	}
 
-	user, err := c.Service.CreateUser(user.FirstName, user.LastName)
+	user, err := c.Service.CreateUser(ctx.UserContext(), request.FirstName, request.LastName)
 	if err != nil {
-		log.Printf("Error occurred in svc.CreateUser: " + err.Error())
+		loggerOrDefault(c.Logger).ErrorContext(ctx.UserContext(), "Error occurred in svc.CreateUser", "error", err)
 		return err
 	}
 
@@ -54,9 +72,40 @@ func (c *UsersController) CreateUser(ctx *fiber.Ctx) error {
 }
 
 func (c *UsersController) GetAllUsers(ctx *fiber.Ctx) error {
-	users, err := c.Service.GetAllUsers()
+	if err := c.authorize(ctx, auth.ListUsers, 0); err != nil {
+		return err
+	}
+
+	query, err := ParseUserQuery(ctx)
+	if err != nil {
+		return apperrors.New(apperrors.InvalidRequest, err.Error())
+	}
+
+	cursorMode := ctx.Context().QueryArgs().Has("cursor")
+	if cursorMode && ctx.Query("offset") != "" {
+		return apperrors.New(apperrors.InvalidRequest, "cursor and offset cannot be combined")
+	}
+
+	// Check whether the client's copy is still current before fetching and serializing the page
+	stamp, err := c.Service.GetAllUsersStamp(ctx.UserContext(), query)
+	if err != nil {
+		loggerOrDefault(c.Logger).ErrorContext(ctx.UserContext(), "Error occurred in svc.GetAllUsersStamp", "error", err)
+		return err
+	}
+	// No Last-Modified, as deleting or purging a user removes it from the listing without advancing the latest update
+	SetValidators(ctx, UsersETag(stamp), time.Time{})
+	if NotModified(ctx, UsersETag(stamp), time.Time{}) {
+		return ctx.SendStatus(fiber.StatusNotModified)
+	}
+
+	// Keyset pagination is opted into by passing a cursor, which is empty for the first page
+	if cursorMode {
+		return c.getUsersByCursor(ctx, query)
+	}
+
+	users, total, err := c.Service.GetAllUsers(ctx.UserContext(), query)
 	if err != nil {
-		log.Printf("Error occurred in svc.GetAllUsers: " + err.Error())
+		loggerOrDefault(c.Logger).ErrorContext(ctx.UserContext(), "Error occurred in svc.GetAllUsers", "error", err)
 		return err
 	}
 
@@ -65,20 +114,70 @@ func (c *UsersController) GetAllUsers(ctx *fiber.Ctx) error {
 		serializedUsers[i] = Serialize(user)
 	}
 
-	return ctx.Status(200).JSON(serializedUsers)
+	response := UserList{
+		Data:   serializedUsers,
+		Total:  total,
+		Limit:  query.Limit,
+		Offset: query.Offset,
+	}
+	if int64(query.Offset+len(users)) < total {
+		response.Links.Next = pageLink(ctx, query.Offset+query.Limit)
+	}
+	if query.Offset > 0 {
+		prevOffset := query.Offset - query.Limit
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		response.Links.Prev = pageLink(ctx, prevOffset)
+	}
+
+	return ctx.Status(200).JSON(response)
+}
+
+func (c *UsersController) getUsersByCursor(ctx *fiber.Ctx, query *services.UserQuery) error {
+	users, nextCursor, err := c.Service.GetUsersByCursor(ctx.UserContext(), query, ctx.Query("cursor"))
+	if err != nil {
+		loggerOrDefault(c.Logger).ErrorContext(ctx.UserContext(), "Error occurred in svc.GetUsersByCursor", "error", err)
+		return err
+	}
+
+	var serializedUsers = make([]User, len(users))
+	for i, user := range users {
+		serializedUsers[i] = Serialize(user)
+	}
+
+	response := UserCursorList{
+		Data:       serializedUsers,
+		Limit:      query.Limit,
+		NextCursor: nextCursor,
+	}
+	if nextCursor != "" {
+		response.Links.Next = cursorLink(ctx, nextCursor)
+	}
+
+	return ctx.Status(200).JSON(response)
 }
 
 func (c *UsersController) GetUserById(ctx *fiber.Ctx) error {
 	id, err := ctx.ParamsInt("id")
 	if err != nil {
-		return ctx.Status(400).JSON(APIResponse{Message: "User ID must be an integer"})
+		return apperrors.New(apperrors.InvalidID, "User ID must be an integer")
+	}
+
+	if err := c.authorize(ctx, auth.ReadUser, id); err != nil {
+		return err
 	}
 
-	user, err := c.Service.GetUser(id)
+	user, err := c.Service.GetUser(ctx.UserContext(), id)
 	if err != nil {
 		return err
 	}
 
+	SetValidators(ctx, UserETag(user), UserLastModified(user))
+	if NotModified(ctx, UserETag(user), UserLastModified(user)) {
+		return ctx.SendStatus(fiber.StatusNotModified)
+	}
+
 	serializedUser := Serialize(*user)
 	return ctx.Status(200).JSON(serializedUser)
 }
@@ -86,19 +185,62 @@ func (c *UsersController) GetUserById(ctx *fiber.Ctx) error {
 func (c *UsersController) UpdateUser(ctx *fiber.Ctx) error {
 	id, err := ctx.ParamsInt("id")
 	if err != nil {
-		return ctx.Status(400).JSON(APIResponse{Message: "User ID must be an integer"})
+		return apperrors.New(apperrors.InvalidID, "User ID must be an integer")
 	}
 
-	var updatedUser models.User
-	if err := ParseBody(ctx, &updatedUser); err != nil {
-		return ctx.Status(400).JSON(APIResponse{Message: err.Error()})
+	if err := c.authorize(ctx, auth.UpdateUser, id); err != nil {
+		return err
+	}
+
+	request := &ReplaceUserRequest{}
+	if err := ParseBody(ctx, request); err != nil {
+		return err
 	}
 
-	user, err := c.Service.UpdateUser(id, &updatedUser.FirstName, &updatedUser.LastName)
+	user, err := c.Service.UpdateUser(ctx.UserContext(), id, &request.FirstName, &request.LastName, ParseIfMatch(ctx))
 	if err != nil {
 		return err
 	}
 
+	ctx.Set(fiber.HeaderETag, UserETag(user))
+	serializedUser := Serialize(*user)
+	return ctx.Status(200).JSON(serializedUser)
+}
+
+func (c *UsersController) PatchUser(ctx *fiber.Ctx) error {
+	id, err := ctx.ParamsInt("id")
+	if err != nil {
+		return apperrors.New(apperrors.InvalidID, "User ID must be an integer")
+	}
+
+	if err := c.authorize(ctx, auth.UpdateUser, id); err != nil {
+		return err
+	}
+
+	user, err := c.Service.GetUser(ctx.UserContext(), id)
+	if err != nil {
+		return err
+	}
+
+	// The patch is computed against this version of the user, so it must only be saved over that version
+	precondition := ParseIfMatch(ctx)
+	if !precondition.Allows(user) {
+		return apperrors.New(apperrors.UserModified, "user has been modified")
+	}
+	precondition = &services.Precondition{Versions: []uint{user.Version}}
+
+	current := &ReplaceUserRequest{FirstName: user.FirstName, LastName: user.LastName}
+	request := &ReplaceUserRequest{}
+	if err := ApplyPatch(ctx, current, request); err != nil {
+		return err
+	}
+
+	user, err = c.Service.UpdateUser(ctx.UserContext(), id, &request.FirstName, &request.LastName, precondition)
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderETag, UserETag(user))
 	serializedUser := Serialize(*user)
 	return ctx.Status(200).JSON(serializedUser)
 }
@@ -106,13 +248,53 @@ func (c *UsersController) UpdateUser(ctx *fiber.Ctx) error {
 func (c *UsersController) DeleteUser(ctx *fiber.Ctx) error {
 	id, err := ctx.ParamsInt("id")
 	if err != nil {
-		return ctx.Status(400).JSON(APIResponse{Message: "User ID must be an integer"})
+		return apperrors.New(apperrors.InvalidID, "User ID must be an integer")
+	}
+
+	// ?hard=true purges the user rather than soft deleting it
+	hard, err := parseBoolQuery(ctx, "hard")
+	if err != nil {
+		return apperrors.New(apperrors.InvalidRequest, err.Error())
+	}
+	if hard {
+		if err := c.authorize(ctx, auth.PurgeUser, id); err != nil {
+			return err
+		}
+		err = c.Service.PurgeUser(ctx.UserContext(), id, ParseIfMatch(ctx))
+		if err != nil {
+			return err
+		}
+		return ctx.Status(200).JSON(APIResponse{Message: "Successfully purged user"})
+	}
+
+	if err := c.authorize(ctx, auth.DeleteUser, id); err != nil {
+		return err
 	}
 
-	err = c.Service.DeleteUser(id)
+	err = c.Service.DeleteUser(ctx.UserContext(), id, ParseIfMatch(ctx))
 	if err != nil {
 		return err
 	}
 
 	return ctx.Status(200).JSON(APIResponse{Message: "Successfully deleted user"})
 }
+
+func (c *UsersController) RestoreUser(ctx *fiber.Ctx) error {
+	id, err := ctx.ParamsInt("id")
+	if err != nil {
+		return apperrors.New(apperrors.InvalidID, "User ID must be an integer")
+	}
+
+	if err := c.authorize(ctx, auth.RestoreUser, id); err != nil {
+		return err
+	}
+
+	user, err := c.Service.RestoreUser(ctx.UserContext(), id)
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderETag, UserETag(user))
+	serializedUser := Serialize(*user)
+	return ctx.Status(200).JSON(serializedUser)
+}
@@ -1,10 +1,14 @@
 package database
 
 import (
+	"context"
 	"errors"
-	"log"
+	"log/slog"
+	"time"
 
-	"gorm.io/driver/mysql"
+	"github.com/conormkelly/fiber-demo/config"
+	"github.com/conormkelly/fiber-demo/migrations"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
@@ -13,32 +17,131 @@ type Database struct {
 	Conn *gorm.DB
 }
 
+// Checks that the database can be reached
+func (database *Database) Ping(ctx context.Context) error {
+	sqlDB, err := database.Conn.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// Closes every connection in the pool, waiting for queries in progress to finish
+func (database *Database) Close() error {
+	sqlDB, err := database.Conn.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
 type Options struct {
-	ConnectionString *string
-	ModelsToMigrate  []interface{}
+	ConnectionString config.Secret
+	Driver           string          // Name of a registered driver, used when the connection string has no URL scheme
+	RunMigrations    bool            // Applies any pending migrations from the migrations package once connected
+	Logger           *slog.Logger    // Defaults to slog.Default()
+	LogLevel         logger.LogLevel // Of GORM's logs, defaults to logger.Warn
+	SlowThreshold    time.Duration   // Queries taking longer are logged as slow, unless it is 0
+	Tracer           trace.Tracer    // Traces every query, if set
+	ConnectRetry     Retry           // Retries connecting while the database can't be reached, e.g. while it starts up
+	OnConnectRetry   func()          // Called before each retry to connect, e.g. to count them
+
+	MaxOpenConns    int           // Limits the connections open at once, unlimited if 0
+	MaxIdleConns    int           // Idle connections kept for reuse, database/sql's default of 2 if 0
+	ConnMaxLifetime time.Duration // Connections are closed once this old, e.g. before MySQL's wait_timeout, never if 0
+	ConnMaxIdleTime time.Duration // Connections are closed once idle for this long, never if 0
+
+	PrepareStmt            bool // Prepares each distinct query once per connection and reuses it
+	SkipDefaultTransaction bool // Doesn't wrap single creates, updates and deletes in a transaction, saving two round trips
 }
 
 func GetConnection(options *Options) (*gorm.DB, error) {
 	var db *gorm.DB
 	var err error
 
-	if options.ConnectionString == nil {
+	if options.ConnectionString == "" {
 		return nil, errors.New("no ConnectionString was provided")
 	}
 
-	db, err = gorm.Open(mysql.Open(*options.ConnectionString), &gorm.Config{})
+	driver, err := resolveDriver(options.Driver, options.ConnectionString.Value())
+	if err != nil {
+		return nil, err
+	}
+	dialector, err := driver(options.ConnectionString.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	log := options.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	logLevel := options.LogLevel
+	if logLevel == 0 {
+		logLevel = logger.Warn
+	}
+
+	err = options.ConnectRetry.Do(context.Background(), func() error {
+		db, err = gorm.Open(parameterizedDialector{dialector}, &gorm.Config{
+			Logger:                 &Logger{Logger: log, Level: logLevel, SlowThreshold: options.SlowThreshold},
+			PrepareStmt:            options.PrepareStmt,
+			SkipDefaultTransaction: options.SkipDefaultTransaction,
+		})
+		if err != nil && db != nil {
+			// Don't leave the failed attempt's pool open
+			if sqlDB, dbErr := db.DB(); dbErr == nil {
+				sqlDB.Close()
+			}
+		}
+		return err
+	}, func(attempt int, delay time.Duration, err error) {
+		log.Warn("Failed to connect to the database, retrying.", "attempt", attempt, "attempts", options.ConnectRetry.Attempts, "delay", delay, "error", err)
+		if options.OnConnectRetry != nil {
+			options.OnConnectRetry()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Timestamps are stored in UTC, so that they compare the same whatever the time zone of the process that wrote them.
+	// The dialect's NowFunc is kept, as it rounds to the precision of MySQL's columns.
+	now := db.Config.NowFunc
+	db.Config.NowFunc = func() time.Time { return now().UTC() }
+
+	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
+	sqlDB.SetMaxOpenConns(options.MaxOpenConns)
+	if options.MaxIdleConns != 0 {
+		sqlDB.SetMaxIdleConns(options.MaxIdleConns)
+	}
+	sqlDB.SetConnMaxLifetime(options.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(options.ConnMaxIdleTime)
+
+	if options.Tracer != nil {
+		if err := db.Use(&TracingPlugin{Tracer: options.Tracer}); err != nil {
+			return nil, err
+		}
+	}
 
-	log.Println("Connected to the database.")
-	db.Logger = logger.Default.LogMode(logger.Info)
+	log.Info("Connected to the database.", "dialect", db.Dialector.Name())
 
-	if len(options.ModelsToMigrate) > 0 {
-		log.Println("Running migrations.")
-		// Variadic function
-		err = db.AutoMigrate(options.ModelsToMigrate...)
+	if options.RunMigrations {
+		log.Info("Running migrations.")
+		migrator, err := migrations.New(db)
+		if err != nil {
+			return nil, err
+		}
+		applied, err := migrator.Up()
+		if err != nil {
+			return nil, err
+		}
+		for _, migration := range applied {
+			log.Info("Applied migration.", "version", migration.Version, "name", migration.Name)
+		}
 	}
 
-	return db, err
+	return db, nil
 }
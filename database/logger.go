@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Logs GORM's messages and queries to a structured logger, with the request ID of the query's context.
+// Failed queries are logged at Error, slow queries at Warn and, at the Info level, every query at Info.
+// Connections from GetConnection log the SQL with placeholders rather than its values.
+type Logger struct {
+	Logger        *slog.Logger
+	Level         logger.LogLevel
+	SlowThreshold time.Duration // Queries taking longer are logged as slow, unless it is 0
+}
+
+// Parses a GORM log level: silent, error, warn or info
+func ParseLogLevel(level string) (logger.LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "silent":
+		return logger.Silent, nil
+	case "error":
+		return logger.Error, nil
+	case "warn":
+		return logger.Warn, nil
+	case "info":
+		return logger.Info, nil
+	}
+	return 0, fmt.Errorf("unknown log level '%s', expected silent, error, warn or info", level)
+}
+
+func (l *Logger) LogMode(level logger.LogLevel) logger.Interface {
+	copy := *l
+	copy.Level = level
+	return &copy
+}
+
+func (l *Logger) Info(ctx context.Context, message string, data ...interface{}) {
+	if l.Level >= logger.Info {
+		l.Logger.InfoContext(ctx, fmt.Sprintf(message, data...))
+	}
+}
+
+func (l *Logger) Warn(ctx context.Context, message string, data ...interface{}) {
+	if l.Level >= logger.Warn {
+		l.Logger.WarnContext(ctx, fmt.Sprintf(message, data...))
+	}
+}
+
+func (l *Logger) Error(ctx context.Context, message string, data ...interface{}) {
+	if l.Level >= logger.Error {
+		l.Logger.ErrorContext(ctx, fmt.Sprintf(message, data...))
+	}
+}
+
+func (l *Logger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.Level <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	attrs := func() []any {
+		sql, rows := fc()
+		return []any{"sql", sql, "rows", rows, "duration_ms", float64(elapsed.Microseconds()) / 1000}
+	}
+
+	switch {
+	// Not finding a record is an expected outcome, not a failure
+	case err != nil && l.Level >= logger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		l.Logger.ErrorContext(ctx, "Query failed", append(attrs(), "error", err)...)
+	case l.SlowThreshold > 0 && elapsed > l.SlowThreshold && l.Level >= logger.Warn:
+		l.Logger.WarnContext(ctx, "Slow query", append(attrs(), "threshold_ms", l.SlowThreshold.Milliseconds())...)
+	case l.Level >= logger.Info:
+		l.Logger.InfoContext(ctx, "Query", attrs()...)
+	}
+}
+
+// Leaves the values out of the SQL that GORM hands its logger, as they may be personal data or secrets such as API key hashes.
+// GORM only explains statements for logging, so queries themselves are unaffected.
+type parameterizedDialector struct {
+	gorm.Dialector
+}
+
+func (dialector parameterizedDialector) Explain(sql string, vars ...interface{}) string {
+	return sql
+}
+
+// The rest forward the optional interfaces of the wrapped dialector, which embedding doesn't expose
+
+func (dialector parameterizedDialector) Apply(config *gorm.Config) error {
+	if applier, ok := dialector.Dialector.(interface{ Apply(*gorm.Config) error }); ok {
+		return applier.Apply(config)
+	}
+	return nil
+}
+
+func (dialector parameterizedDialector) SavePoint(tx *gorm.DB, name string) error {
+	if savePointer, ok := dialector.Dialector.(gorm.SavePointerDialectorInterface); ok {
+		return savePointer.SavePoint(tx, name)
+	}
+	return gorm.ErrUnsupportedDriver
+}
+
+func (dialector parameterizedDialector) RollbackTo(tx *gorm.DB, name string) error {
+	if savePointer, ok := dialector.Dialector.(gorm.SavePointerDialectorInterface); ok {
+		return savePointer.RollbackTo(tx, name)
+	}
+	return gorm.ErrUnsupportedDriver
+}
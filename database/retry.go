@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/dberrors"
+)
+
+// How many times, and how far apart, a Retryable failure is retried
+type Retry struct {
+	Attempts  int           // Retries made after the first try, 0 for none
+	BaseDelay time.Duration // The most that is waited before the first retry, doubling for each one after it
+	MaxDelay  time.Duration // Caps the doubling, unless it is 0
+}
+
+// The delay before the given retry, counting from 1. It is picked at random up to the backoff,
+// so that callers that failed together don't all retry together ("full jitter").
+func (retry Retry) Delay(attempt int) time.Duration {
+	backoff := retry.BaseDelay
+	for i := 1; i < attempt && (retry.MaxDelay == 0 || backoff < retry.MaxDelay); i++ {
+		backoff *= 2
+	}
+	if retry.MaxDelay > 0 && backoff > retry.MaxDelay {
+		backoff = retry.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// Calls op until it succeeds, fails with an error that isn't Retryable, or runs out of attempts, returning its last error.
+// onRetry, if set, is called before each retry e.g. to log it. Waiting stops early when ctx is done.
+func (retry Retry) Do(ctx context.Context, op func() error, onRetry func(attempt int, delay time.Duration, err error)) error {
+	err := op()
+	for attempt := 1; attempt <= retry.Attempts && dberrors.Classify(err) == dberrors.Retryable; attempt++ {
+		delay := retry.Delay(attempt)
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = op()
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A nullable timestamp that a query computes, e.g. MAX(updated_at). SQLite only converts columns declared
+// as timestamps, so returns computed ones as text, which is parsed in the same way the driver parses columns.
+type NullTime struct {
+	sql.NullTime
+}
+
+func (t *NullTime) Scan(value interface{}) error {
+	var text string
+	switch value := value.(type) {
+	case string:
+		text = value
+	case []byte:
+		text = string(value)
+	default:
+		return t.NullTime.Scan(value)
+	}
+
+	text = strings.TrimSuffix(text, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if parsed, err := time.ParseInLocation(format, text, time.UTC); err == nil {
+			t.Time, t.Valid = parsed, true
+			return nil
+		}
+	}
+	return fmt.Errorf("can't parse '%s' as a timestamp", text)
+}
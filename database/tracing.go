@@ -0,0 +1,79 @@
+package database
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// Key of the statement's settings holding its span
+const spanKey = "tracing:span"
+
+// A GORM plugin that traces every query as a child of the span in its context,
+// so queries must be made with WithContext to be part of a request's trace
+type TracingPlugin struct {
+	Tracer trace.Tracer
+}
+
+func (plugin *TracingPlugin) Name() string {
+	return "tracing"
+}
+
+func (plugin *TracingPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:create").Register("tracing:before_create", plugin.before("create")),
+		callbacks.Create().After("gorm:create").Register("tracing:after_create", plugin.after),
+		callbacks.Query().Before("gorm:query").Register("tracing:before_query", plugin.before("query")),
+		callbacks.Query().After("gorm:query").Register("tracing:after_query", plugin.after),
+		callbacks.Update().Before("gorm:update").Register("tracing:before_update", plugin.before("update")),
+		callbacks.Update().After("gorm:update").Register("tracing:after_update", plugin.after),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", plugin.before("delete")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", plugin.after),
+		callbacks.Row().Before("gorm:row").Register("tracing:before_row", plugin.before("row")),
+		callbacks.Row().After("gorm:row").Register("tracing:after_row", plugin.after),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", plugin.before("raw")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", plugin.after),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (plugin *TracingPlugin) before(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		_, span := plugin.Tracer.Start(db.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemKey.String(db.Dialector.Name())),
+		)
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+func (plugin *TracingPlugin) after(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	defer span.End()
+
+	span.SetAttributes(
+		semconv.DBQueryText(db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if db.Statement.Table != "" {
+		span.SetAttributes(semconv.DBCollectionName(db.Statement.Table))
+	}
+	// Not finding a record is an expected outcome, not a failure
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+}
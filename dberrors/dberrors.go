@@ -0,0 +1,99 @@
+// Package dberrors works out what a failed query means, whichever driver reported it,
+// so that callers such as the services and the migration lock don't depend on driver error types.
+package dberrors
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// What a failed query means for the caller, regardless of the driver that reported it
+type ErrorKind int
+
+const (
+	Unclassified ErrorKind = iota // Unexpected, e.g. a missing table or a syntax error
+	Conflict                      // Clashes with existing rows, e.g. a duplicate unique key
+	Retryable                     // Transient, e.g. a deadlock or a dropped connection, so may succeed if tried again
+	InvalidInput                  // Rejected by the schema, e.g. a value too long for its column
+)
+
+func (kind ErrorKind) String() string {
+	switch kind {
+	case Conflict:
+		return "conflict"
+	case Retryable:
+		return "retryable"
+	case InvalidInput:
+		return "invalid_input"
+	}
+	return "unclassified"
+}
+
+// MySQL server error numbers, see https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+var mysqlErrors = map[uint16]ErrorKind{
+	1062: Conflict,     // ER_DUP_ENTRY
+	1586: Conflict,     // ER_DUP_ENTRY_WITH_KEY_NAME
+	1451: Conflict,     // ER_ROW_IS_REFERENCED_2, deleting a row that others refer to
+	1452: Conflict,     // ER_NO_REFERENCED_ROW_2, referring to a row that doesn't exist, a Conflict as SQLite can't tell it from 1451
+	1205: Retryable,    // ER_LOCK_WAIT_TIMEOUT
+	1213: Retryable,    // ER_LOCK_DEADLOCK
+	1040: Retryable,    // ER_CON_COUNT_ERROR, too many connections
+	1053: Retryable,    // ER_SERVER_SHUTDOWN
+	1290: Retryable,    // ER_OPTION_PREVENTS_STATEMENT, e.g. --read-only during a failover
+	1927: Retryable,    // ER_CONNECTION_KILLED
+	1048: InvalidInput, // ER_BAD_NULL_ERROR
+	1264: InvalidInput, // ER_WARN_DATA_OUT_OF_RANGE
+	1265: InvalidInput, // WARN_DATA_TRUNCATED
+	1292: InvalidInput, // ER_TRUNCATED_WRONG_VALUE
+	1364: InvalidInput, // ER_NO_DEFAULT_FOR_FIELD
+	1366: InvalidInput, // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	1406: InvalidInput, // ER_DATA_TOO_LONG
+	3819: InvalidInput, // ER_CHECK_CONSTRAINT_VIOLATED
+}
+
+// SQLite extended result codes, see https://www.sqlite.org/rescode.html
+var sqliteExtendedErrors = map[sqlite3.ErrNoExtended]ErrorKind{
+	sqlite3.ErrConstraintUnique:     Conflict,
+	sqlite3.ErrConstraintPrimaryKey: Conflict,
+	sqlite3.ErrConstraintForeignKey: Conflict,
+	sqlite3.ErrConstraintNotNull:    InvalidInput,
+	sqlite3.ErrConstraintCheck:      InvalidInput,
+}
+
+// SQLite primary result codes, for when the extended code isn't specific enough
+var sqliteErrors = map[sqlite3.ErrNo]ErrorKind{
+	sqlite3.ErrBusy:     Retryable,
+	sqlite3.ErrLocked:   Retryable,
+	sqlite3.ErrTooBig:   InvalidInput,
+	sqlite3.ErrMismatch: InvalidInput,
+}
+
+// Works out what kind of failure a GORM or driver error is, from MySQL error numbers and SQLite result codes.
+// Errors of other drivers, and those that aren't understood, are Unclassified.
+func Classify(err error) ErrorKind {
+	var mysqlError *gomysql.MySQLError
+	var sqliteError sqlite3.Error
+	var netError net.Error
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// Cancelled queries are the caller's doing, and DeadlineExceeded would otherwise pass as a net.Error
+		return Unclassified
+	case errors.As(err, &mysqlError):
+		return mysqlErrors[mysqlError.Number]
+	case errors.As(err, &sqliteError):
+		if kind, ok := sqliteExtendedErrors[sqliteError.ExtendedCode]; ok {
+			return kind
+		}
+		return sqliteErrors[sqliteError.Code]
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, gomysql.ErrInvalidConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &netError):
+		// The connection was dropped, so a new one may well succeed
+		return Retryable
+	}
+	return Unclassified
+}
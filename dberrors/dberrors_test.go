@@ -0,0 +1,68 @@
+package dberrors
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected ErrorKind
+	}{
+		{&gomysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'idx_api_keys_prefix'"}, Conflict},
+		{fmt.Errorf("creating key: %w", &gomysql.MySQLError{Number: 1451}), Conflict},
+		{&gomysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, Retryable},
+		{&gomysql.MySQLError{Number: 1205}, Retryable},
+		{&gomysql.MySQLError{Number: 1406, Message: "Data too long for column 'first_name'"}, InvalidInput},
+		{&gomysql.MySQLError{Number: 1146, Message: "Table 'go_app.users' doesn't exist"}, Unclassified},
+		{gomysql.ErrInvalidConn, Retryable},
+		{driver.ErrBadConn, Retryable},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, Retryable},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}, Conflict},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintNotNull}, InvalidInput},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, Retryable},
+		{sqlite3.Error{Code: sqlite3.ErrError}, Unclassified},
+		{context.DeadlineExceeded, Unclassified},
+		{gorm.ErrRecordNotFound, Unclassified},
+		{nil, Unclassified},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, Classify(test.err), fmt.Sprint(test.err))
+	}
+}
+
+// The same failure is classified the same way whichever driver reports it
+func TestClassifyAcrossDrivers(t *testing.T) {
+	testCases := []struct {
+		description string
+		mysql       error
+		sqlite      error
+		expected    ErrorKind
+	}{
+		{"duplicate key", &gomysql.MySQLError{Number: 1062}, sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}, Conflict},
+		{"duplicate primary key", &gomysql.MySQLError{Number: 1062}, sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintPrimaryKey}, Conflict},
+		{"deleting a referenced row", &gomysql.MySQLError{Number: 1451}, sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintForeignKey}, Conflict},
+		{"referring to a missing row", &gomysql.MySQLError{Number: 1452}, sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintForeignKey}, Conflict},
+		{"null in a NOT NULL column", &gomysql.MySQLError{Number: 1048}, sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintNotNull}, InvalidInput},
+		{"failed check constraint", &gomysql.MySQLError{Number: 3819}, sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintCheck}, InvalidInput},
+		{"lock contention", &gomysql.MySQLError{Number: 1205}, sqlite3.Error{Code: sqlite3.ErrBusy}, Retryable},
+		{"deadlock", &gomysql.MySQLError{Number: 1213}, sqlite3.Error{Code: sqlite3.ErrLocked}, Retryable},
+		{"missing table", &gomysql.MySQLError{Number: 1146}, sqlite3.Error{Code: sqlite3.ErrError}, Unclassified},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, Classify(test.mysql), "mysql - "+test.description)
+		assert.Equal(t, test.expected, Classify(test.sqlite), "sqlite - "+test.description)
+	}
+}
@@ -0,0 +1,132 @@
+// Package health runs the checks that decide whether the app is ready to serve requests,
+// and remembers each check's latest result and last error for reporting.
+package health
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// How long a single check may take before it is failed, unless the Checker says otherwise
+const DefaultTimeout = 2 * time.Second
+
+// A dependency that must be working for the app to be ready, such as the database
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// The outcome of a check's latest run, and its last failure, which may be from an earlier run.
+// Errors are logged rather than serialized, as they can describe the infrastructure to unauthenticated callers.
+type Result struct {
+	Status      string     `json:"status"`
+	LatencyMS   float64    `json:"latency_ms"`
+	Error       string     `json:"-"`
+	LastError   string     `json:"-"`
+	LastErrorAt *time.Time `json:"-"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Runs the checks, and fails readiness once the app starts shutting down
+type Checker struct {
+	Checks  []Check
+	Timeout time.Duration
+	Logger  *slog.Logger // Logs checks that start failing or recover, defaults to slog.Default()
+
+	shuttingDown int32
+	mutex        sync.Mutex
+	results      map[string]Result
+}
+
+func NewChecker(checks ...Check) *Checker {
+	return &Checker{Checks: checks, Timeout: DefaultTimeout}
+}
+
+// Makes every later Run report the app as unavailable, so that it is taken out of rotation while draining
+func (checker *Checker) ShutDown() {
+	atomic.StoreInt32(&checker.shuttingDown, 1)
+}
+
+func (checker *Checker) ShuttingDown() bool {
+	return atomic.LoadInt32(&checker.shuttingDown) == 1
+}
+
+// Runs every check concurrently, each with its own timeout
+func (checker *Checker) Run(ctx context.Context) Report {
+	results := make([]Result, len(checker.Checks))
+	var wg sync.WaitGroup
+	for i, check := range checker.Checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = checker.run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: map[string]Result{}}
+	if checker.ShuttingDown() {
+		report.Status = StatusUnavailable
+		report.Checks["shutdown"] = Result{Status: StatusUnavailable, Error: "the app is shutting down"}
+	}
+	for i, check := range checker.Checks {
+		report.Checks[check.Name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	return report
+}
+
+func (checker *Checker) run(ctx context.Context, check Check) Result {
+	timeout := checker.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Check(ctx)
+	latency := time.Since(start)
+
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if checker.results == nil {
+		checker.results = map[string]Result{}
+	}
+
+	previous, ran := checker.results[check.Name]
+	result := previous
+	result.Status, result.LatencyMS, result.Error = StatusOK, float64(latency.Microseconds())/1000, ""
+	if err != nil {
+		now := time.Now()
+		result.Status, result.Error = StatusUnavailable, err.Error()
+		result.LastError, result.LastErrorAt = err.Error(), &now
+	}
+	checker.results[check.Name] = result
+
+	// Only changes are logged, as the checks run on every probe
+	logger := checker.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if err != nil && result.Error != previous.Error {
+		logger.WarnContext(ctx, "Health check failed.", "check", check.Name, "error", err)
+	} else if err == nil && ran && previous.Status != StatusOK {
+		logger.InfoContext(ctx, "Health check recovered.", "check", check.Name)
+	}
+	return result
+}
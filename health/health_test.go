@@ -0,0 +1,41 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	var dbError error
+	checker := NewChecker(
+		Check{Name: "database", Check: func(ctx context.Context) error { return dbError }},
+		Check{Name: "slow", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	)
+	checker.Timeout = 10 * time.Millisecond
+
+	dbError = errors.New("connection refused")
+	report := checker.Run(context.Background())
+	assert.Equal(t, StatusUnavailable, report.Status)
+	assert.Equal(t, "connection refused", report.Checks["database"].Error)
+	assert.Equal(t, "context deadline exceeded", report.Checks["slow"].Error, "checks time out")
+
+	checker.Checks = checker.Checks[:1]
+	dbError = nil
+	report = checker.Run(context.Background())
+	assert.Equal(t, StatusOK, report.Status)
+	assert.Equal(t, "", report.Checks["database"].Error)
+	assert.Equal(t, "connection refused", report.Checks["database"].LastError, "the last error outlives recovery")
+	assert.NotNil(t, report.Checks["database"].LastErrorAt)
+
+	checker.ShutDown()
+	report = checker.Run(context.Background())
+	assert.Equal(t, StatusUnavailable, report.Status, "shutting down fails readiness even when every check passes")
+	assert.Equal(t, StatusOK, report.Checks["database"].Status)
+}
@@ -0,0 +1,76 @@
+// Package logging creates the app's structured logger, and carries request IDs through contexts
+// so that every line logged while handling a request can be tied back to it.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey struct{}
+
+// Returns a copy of ctx carrying the ID of the request it belongs to
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, requestID)
+}
+
+// The ID of the request ctx belongs to, or "" outside of a request
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(contextKey{}).(string)
+	return requestID
+}
+
+// Creates a logger writing "json" or "text" lines, which adds the request and trace IDs of the context passed to e.g. InfoContext
+func New(out io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json", "":
+		handler = slog.NewJSONHandler(out, options)
+	case "text":
+		handler = slog.NewTextHandler(out, options)
+	default:
+		return nil, fmt.Errorf("unknown log format '%s', expected json or text", format)
+	}
+	return slog.New(requestIDHandler{handler}), nil
+}
+
+// Parses a level such as "debug", "info", "warn" or "error"
+func ParseLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	err := parsed.UnmarshalText([]byte(level))
+	return parsed, err
+}
+
+// Adds request_id, trace_id and span_id attributes to records logged with a request's context
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (handler requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if ctx != nil {
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+		}
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+func (handler requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{handler.Handler.WithAttrs(attrs)}
+}
+
+func (handler requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{handler.Handler.WithGroup(name)}
+}
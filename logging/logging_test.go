@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRequestID(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "json", slog.LevelInfo)
+	assert.Nil(t, err)
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	assert.Equal(t, "abc123", RequestID(ctx))
+	assert.Equal(t, "", RequestID(context.Background()))
+
+	logger.With("service", "users").InfoContext(ctx, "User created.", "user_id", 1)
+	logger.InfoContext(context.Background(), "Outside a request.")
+	logger.DebugContext(ctx, "Below the level.")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var record map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "User created.", record["msg"])
+	assert.Equal(t, "abc123", record["request_id"], "the request ID survives With")
+	assert.Equal(t, "users", record["service"])
+
+	record = nil
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.NotContains(t, record, "request_id")
+}
+
+func TestNew(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(&out, "text", slog.LevelWarn)
+	assert.Nil(t, err)
+	logger.WarnContext(WithRequestID(context.Background(), "abc123"), "Slow query")
+	assert.Contains(t, out.String(), `msg="Slow query" request_id=abc123`)
+
+	out.Reset()
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	spanCtx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+	logger.WarnContext(spanCtx, "Slow query")
+	assert.Contains(t, out.String(), "trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=00f067aa0ba902b7")
+
+	_, err = New(&out, "xml", slog.LevelInfo)
+	assert.Equal(t, "unknown log format 'xml', expected json or text", err.Error())
+
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
@@ -1,68 +1,105 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"log"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/auth"
 	"github.com/conormkelly/fiber-demo/controllers"
 	"github.com/conormkelly/fiber-demo/database"
-	"github.com/conormkelly/fiber-demo/models"
+	"github.com/conormkelly/fiber-demo/health"
+	"github.com/conormkelly/fiber-demo/metrics"
+	"github.com/conormkelly/fiber-demo/middleware"
+	"github.com/conormkelly/fiber-demo/migrations"
 	"github.com/conormkelly/fiber-demo/services"
+	"github.com/conormkelly/fiber-demo/tracing"
 	"github.com/gofiber/fiber/v2"
 	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type Options struct {
-	ConnectionString  *string // The DSN for the DB e.g. "user:password@tcp(localhost:3306)/go_app"
-	ShouldAutoMigrate bool
-	Port              *string
+// Routes that can be called without a bearer token
+var publicPaths = []string{"/healthz", "/readyz", "/health"}
+
+// Routes whose Cache-Control header is configurable via APP_CACHE_CONTROL_<ROUTE>, e.g. APP_CACHE_CONTROL_USERS_GET.
+// Clients must revalidate by default, which conditional GETs make cheap.
+var defaultCacheControl = map[string]string{
+	"users.list": "private, no-cache",
+	"users.get":  "private, no-cache",
+}
+
+// Routes whose timeout is configurable via APP_TIMEOUTS_<ROUTE>, e.g. APP_TIMEOUTS_USERS_LIST, defaulting to APP_REQUEST_TIMEOUT
+var timedRoutes = []string{
+	"users.create", "users.list", "users.get", "users.update", "users.patch", "users.delete", "users.restore",
+	"keys.create", "keys.list", "keys.delete",
 }
 
 type App struct {
 	Options *Options
 	Fiber   *fiber.App
 	DB      *database.Database
-}
+	Keys    auth.KeySource
+	Policy  auth.Policy
+	Health  *health.Checker
+	Metrics *metrics.Metrics
+	Logger  *slog.Logger     // Defaults to slog.Default()
+	Tracing *tracing.Tracing // Defaults to tracing.Disabled()
 
-// Parse environment variable config into Options
-func GetAppOptions() (*Options, error) {
-	options := Options{}
-	var configErrors error
+	// The parent of every request's context, cancelled if requests are still in progress when shutting down times out
+	requests       context.Context
+	cancelRequests context.CancelFunc
 
-	dbConnectionString := os.Getenv("APP_DB_CONN_STRING")
-	if dbConnectionString == "" {
-		err := errors.New("APP_DB_CONN_STRING is required")
-		configErrors = multierror.Append(configErrors, err)
-		options.ConnectionString = nil
-	} else {
-		options.ConnectionString = &dbConnectionString
-	}
+	// Made by ConnectDB, and counted once Metrics exist
+	connectRetries int
+}
 
-	port := os.Getenv("APP_PORT")
-	if port == "" {
-		err := errors.New("APP_PORT is required")
-		configErrors = multierror.Append(configErrors, err)
-		options.Port = nil
-	} else {
-		options.Port = &port
+func (app *App) logger() *slog.Logger {
+	if app.Logger == nil {
+		return slog.Default()
 	}
+	return app.Logger
+}
 
-	options.ShouldAutoMigrate = os.Getenv("APP_RUN_AUTO_MIGRATE") == "true"
-
-	return &options, configErrors
+func (app *App) tracing() *tracing.Tracing {
+	if app.Tracing == nil {
+		app.Tracing = tracing.Disabled()
+	}
+	return app.Tracing
 }
 
 // Creates DB connection based on supplied config
 func (app *App) ConnectDB() error {
-	var modelsToMigrate = []interface{}{}
-	if app.Options.ShouldAutoMigrate {
-		modelsToMigrate = []interface{}{&models.User{}}
+	logLevel, err := database.ParseLogLevel(app.Options.DBLogLevel)
+	if err != nil {
+		return err
 	}
 
 	dbOptions := &database.Options{
-		ConnectionString: app.Options.ConnectionString,
-		ModelsToMigrate:  modelsToMigrate,
+		ConnectionString:       app.Options.connectionString(),
+		Driver:                 app.Options.DBDriver,
+		RunMigrations:          app.Options.ShouldAutoMigrate,
+		Logger:                 app.logger(),
+		LogLevel:               logLevel,
+		SlowThreshold:          app.Options.DBSlowThreshold,
+		Tracer:                 app.tracing().Tracer(),
+		ConnectRetry:           app.Options.connectRetry(),
+		OnConnectRetry:         func() { app.connectRetries++ },
+		MaxOpenConns:           app.Options.DBMaxOpenConns,
+		MaxIdleConns:           app.Options.DBMaxIdleConns,
+		ConnMaxLifetime:        app.Options.DBConnMaxLifetime,
+		ConnMaxIdleTime:        app.Options.DBConnMaxIdleTime,
+		PrepareStmt:            app.Options.DBPrepareStmt,
+		SkipDefaultTransaction: app.Options.DBSkipDefaultTransaction,
 	}
 
 	conn, err := database.GetConnection(dbOptions)
@@ -73,25 +110,64 @@ func (app *App) ConnectDB() error {
 	return nil
 }
 
+// Loads the keys used to verify bearer tokens, and the policy deciding what each caller may do
+func (app *App) ConfigureAuth() error {
+	app.Policy = auth.DefaultPolicy
+	if app.Options.PolicyFile != "" {
+		policy, err := auth.LoadPolicy(app.Options.PolicyFile)
+		if err != nil {
+			return err
+		}
+		app.Policy = policy
+	}
+
+	var keys auth.KeySources
+	if app.Options.JWTSecret != "" {
+		keys = append(keys, auth.Secret([]byte(app.Options.JWTSecret.Value())))
+	}
+	if app.Options.JWTKeysFile != "" {
+		fileKeys, err := auth.NewFileKeySource(app.Options.JWTKeysFile, app.Options.JWTKeysRefresh)
+		if err != nil {
+			return err
+		}
+		fileKeys.Logger = app.logger()
+		keys = append(keys, fileKeys)
+	}
+
+	app.Keys = keys
+	return nil
+}
+
 func (app *App) ConfigureFiber() {
 	// Create a new fiber instance with custom config
 	fiberApp := fiber.New(fiber.Config{
 		// Override default error handler
 		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			// Status code defaults to 500
-			code := fiber.StatusInternalServerError
-
-			// Retrieve the custom status code if it's an fiber.*Error
-			if e, ok := err.(*fiber.Error); ok {
-				code = e.Code
-			} else {
-				// Log, but return a generic error to client to avoid leaking error details
-				log.Printf("An application error occured: " + err.Error())
-				err = fiber.NewError(500, "sorry, something went wrong")
+			// Errors that weren't meant for clients become a generic INTERNAL_ERROR
+			appError := apperrors.From(err)
+			switch appError.Code {
+			case apperrors.Internal:
+				app.logger().ErrorContext(ctx.UserContext(), "An application error occurred.", "error", err, "method", ctx.Method(), "path", ctx.Path())
+				trace.SpanFromContext(ctx.UserContext()).RecordError(err)
+			case apperrors.RequestTimeout, apperrors.RequestCancelled, apperrors.DatabaseUnavailable:
+				// The route's deadline passed, see middleware.Timeout, requests were cancelled when shutting down timed out,
+				// or the database failed in a way that should pass
+				app.logger().WarnContext(ctx.UserContext(), appError.Title()+".", "error", err, "method", ctx.Method(), "path", ctx.Path())
+			}
+			if appError.RetryAfter > 0 {
+				ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(appError.RetryAfter.Seconds()))))
 			}
 
-			// Send custom error
-			return ctx.Status(code).JSON(controllers.APIResponse{Message: err.Error()})
+			// The request ID is included so that the error can be found in the logs
+			requestID := middleware.RequestIDFrom(ctx)
+			if app.Options.LegacyErrors {
+				return ctx.Status(appError.Status()).JSON(controllers.APIResponse{Message: appError.Detail, Errors: appError.Fields, RequestID: requestID})
+			}
+			if err := ctx.Status(appError.Status()).JSON(appError.Problem(ctx.Path(), requestID)); err != nil {
+				return err
+			}
+			ctx.Set(fiber.HeaderContentType, apperrors.MIMEProblemJSON)
+			return nil
 		},
 	})
 
@@ -99,42 +175,223 @@ func (app *App) ConfigureFiber() {
 }
 
 func (app *App) InitializeRoutes() {
-	usersController := &controllers.UsersController{Service: &services.UserService{DB: app.DB}}
+	app.Metrics = metrics.New()
+	app.Metrics.CountRetries("connect", app.connectRetries)
+	if sqlDB, err := app.DB.Conn.DB(); err == nil {
+		app.Metrics.RegisterDB(sqlDB, app.DB.Conn.Dialector.Name())
+	}
+	app.requests, app.cancelRequests = context.WithCancel(context.Background())
+	app.Fiber.Use(func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(app.requests)
+		return ctx.Next()
+	})
+	// Registered first, so that every log line and error response has a request ID
+	app.Fiber.Use(middleware.RequestID())
+	app.Fiber.Use(app.tracing().Middleware())
+	app.Fiber.Use(middleware.AccessLog(app.logger()))
+	// Registered before the rest, so that requests rejected by later middleware are counted too
+	app.Fiber.Use(app.Metrics.Middleware())
+
+	usersController := &controllers.UsersController{
+		Service: &services.UserService{DB: app.DB, CursorSecret: []byte(app.Options.CursorSecret.Value()), Metrics: app.Metrics, Logger: app.logger(), Tracer: app.tracing().Tracer(), Retry: app.Options.retry()},
+		Policy:  app.Policy,
+		Logger:  app.logger(),
+	}
+	apiKeysController := &controllers.APIKeysController{
+		Service: &services.APIKeyService{DB: app.DB, Logger: app.logger(), Metrics: app.Metrics, Retry: app.Options.retry()},
+		Policy:  app.Policy,
+		Logger:  app.logger(),
+	}
+	app.Health = health.NewChecker(
+		health.Check{Name: "database", Check: app.DB.Ping},
+		health.Check{Name: "migrations", Check: app.checkMigrations},
+	)
+	app.Health.Logger = app.logger()
+	healthController := &controllers.HealthController{Checker: app.Health}
+
+	if app.Options.AuthDisabled {
+		// Every request is made as an admin, so that the whole API can be exercised locally
+		app.logger().Warn("Authentication is disabled.")
+		app.Fiber.Use(middleware.Impersonate(&auth.Claims{Roles: []string{auth.AdminRole}}))
+	} else {
+		app.Fiber.Use(middleware.Authenticate(middleware.AuthConfig{
+			Keys:     app.Keys,
+			APIKeys:  apiKeysController.Service,
+			Issuer:   app.Options.JWTIssuer,
+			Audience: app.Options.JWTAudience,
+			Skip:     middleware.SkipPaths(app.publicPaths()...),
+			Logger:   app.logger(),
+		}))
+	}
+
+	// Every route starts with tracked, so that its requests are labelled with the route in metrics
+	tracked := app.Metrics.Track()
+
+	app.Fiber.Get("/healthz", tracked, healthController.Liveness)
+	app.Fiber.Get("/readyz", tracked, healthController.Readiness)
+	app.Fiber.Get("/health", tracked, healthController.Health)
+	if app.Options.MetricsPublic {
+		app.Fiber.Get("/metrics", tracked, app.Metrics.Handler())
+	} else {
+		app.Fiber.Get("/metrics", tracked, controllers.Authorize(app.Policy, app.logger(), auth.ReadMetrics), app.Metrics.Handler())
+	}
+
+	// Cancels the route's queries once its deadline has passed
+	timeout := func(route string) fiber.Handler {
+		return middleware.Timeout(app.Options.timeout(route))
+	}
+
+	app.Fiber.Post("/api/users", tracked, timeout("users.create"), usersController.CreateUser)
+	app.Fiber.Get("/api/users", tracked, timeout("users.list"), middleware.CacheControl(app.Options.CacheControl["users.list"]), usersController.GetAllUsers)
+	app.Fiber.Get("/api/users/:id", tracked, timeout("users.get"), middleware.CacheControl(app.Options.CacheControl["users.get"]), usersController.GetUserById)
+	app.Fiber.Put("/api/users/:id", tracked, timeout("users.update"), usersController.UpdateUser)
+	app.Fiber.Patch("/api/users/:id", tracked, timeout("users.patch"), usersController.PatchUser)
+	app.Fiber.Delete("/api/users/:id", tracked, timeout("users.delete"), usersController.DeleteUser)
+	app.Fiber.Post("/api/users/:id/restore", tracked, timeout("users.restore"), usersController.RestoreUser)
 
-	app.Fiber.Post("/api/users", usersController.CreateUser)
-	app.Fiber.Get("/api/users", usersController.GetAllUsers)
-	app.Fiber.Get("/api/users/:id", usersController.GetUserById)
-	app.Fiber.Put("/api/users/:id", usersController.UpdateUser)
-	app.Fiber.Delete("/api/users/:id", usersController.DeleteUser)
+	app.Fiber.Post("/api/keys", tracked, timeout("keys.create"), apiKeysController.CreateKey)
+	app.Fiber.Get("/api/keys", tracked, timeout("keys.list"), apiKeysController.GetAllKeys)
+	app.Fiber.Delete("/api/keys/:id", tracked, timeout("keys.delete"), apiKeysController.DeleteKey)
+}
+
+// publicPaths, along with /metrics if APP_METRICS_PUBLIC is set
+func (app *App) publicPaths() []string {
+	if app.Options.MetricsPublic {
+		return append(append([]string{}, publicPaths...), "/metrics")
+	}
+	return publicPaths
+}
+
+// Serves the API on the configured port until ctx is cancelled, then shuts down within the ShutdownTimeout.
+// Returns early if the server fails, e.g. because the port is taken.
+func (app *App) Run(ctx context.Context) error {
+	listenError := make(chan error, 1)
+	go func() {
+		listenError <- app.Fiber.Listen(app.Options.Port)
+	}()
+
+	select {
+	case err := <-listenError:
+		if closeError := app.closeDB(); closeError != nil {
+			err = multierror.Append(err, closeError)
+		}
+		if flushError := app.tracing().Shutdown(context.Background()); flushError != nil {
+			err = multierror.Append(err, flushError)
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	// Fail readiness checks for a while before closing the listener, so that load balancers stop sending requests first
+	app.markShuttingDown()
+	if app.Options.ShutdownDelay > 0 {
+		app.logger().Info("Waiting before shutting down.", "delay", app.Options.ShutdownDelay.String())
+		time.Sleep(app.Options.ShutdownDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.Options.ShutdownTimeout)
+	defer cancel()
+	return app.Shutdown(shutdownCtx)
+}
+
+// Stops accepting connections and waits for requests in progress to finish, or for ctx to be done, then closes the DB.
+// Requests that are still running when ctx is done are cut off when the process exits.
+func (app *App) Shutdown(ctx context.Context) error {
+	app.markShuttingDown()
+	app.logger().Info("Shutting down, waiting for requests in progress to finish.")
+
+	var shutdownErrors error
+	if err := app.Fiber.ShutdownWithContext(ctx); err != nil {
+		if ctx.Err() == nil {
+			shutdownErrors = multierror.Append(shutdownErrors, err)
+		} else {
+			shutdownErrors = multierror.Append(shutdownErrors, errors.New("timed out waiting for requests in progress to finish"))
+			// Abandoned requests stop waiting on the DB, which is about to be closed
+			if app.cancelRequests != nil {
+				app.cancelRequests()
+			}
+		}
+	}
+
+	// Only once the server has stopped, so that no new queries can start on a closed DB
+	if err := app.closeDB(); err != nil {
+		shutdownErrors = multierror.Append(shutdownErrors, err)
+	}
+	// Spans of the last requests are still being exported
+	if err := app.tracing().Shutdown(ctx); err != nil {
+		shutdownErrors = multierror.Append(shutdownErrors, errors.New("flushing traces failed - "+err.Error()))
+	}
+	return shutdownErrors
+}
 
-	if app.Options.Port != nil {
-		log.Fatal(app.Fiber.Listen(*app.Options.Port))
+func (app *App) markShuttingDown() {
+	if app.Health != nil {
+		app.Health.ShutDown()
 	}
 }
 
-func Start() error {
+// Fails until every migration has been applied, e.g. while another instance is still migrating
+func (app *App) checkMigrations(ctx context.Context) error {
+	migrator, err := migrations.New(app.DB.Conn)
+	if err != nil {
+		return err
+	}
+	return migrator.CheckApplied(ctx)
+}
+
+func (app *App) closeDB() error {
+	if app.DB == nil {
+		return nil
+	}
+	if err := app.DB.Close(); err != nil {
+		return errors.New("closing the DB failed - " + err.Error())
+	}
+	return nil
+}
+
+// Serves the API until SIGINT or SIGTERM, with config overridden by the given flags, which may be nil
+func Start(flags *flag.FlagSet) error {
 	// Read and validate config
-	options, configError := GetAppOptions()
+	options, configError := LoadAppOptions(flags)
 	if configError != nil {
 		return errors.New("invalid config - " + configError.Error())
 	}
 
+	// Everything is logged through the configured logger, including by packages that use slog's default
+	logger, err := options.logger(os.Stdout)
+	if err != nil {
+		return errors.New("invalid config - " + err.Error())
+	}
+	slog.SetDefault(logger)
+
+	traces, err := tracing.New(context.Background(), options.tracing())
+	if err != nil {
+		return errors.New("tracing config error - " + err.Error())
+	}
+
 	// Create app and connect to DB
-	app := &App{Options: options}
+	app := &App{Options: options, Logger: logger, Tracing: traces}
 	dbError := app.ConnectDB()
 	if dbError != nil {
 		return errors.New("DB connection error - " + dbError.Error())
 	}
 
+	authError := app.ConfigureAuth()
+	if authError != nil {
+		return errors.New("auth config error - " + authError.Error())
+	}
+
 	app.ConfigureFiber()
 	app.InitializeRoutes()
 
-	return nil
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return app.Run(ctx)
 }
 
 func main() {
-	err := Start()
+	err := NewCLI(os.Stdout).Run(os.Args[1:])
 	if err != nil {
-		log.Fatal("Startup failure: " + err.Error())
+		log.Fatal("Failure: " + err.Error())
 	}
 }
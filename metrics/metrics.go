@@ -0,0 +1,128 @@
+// Package metrics collects Prometheus metrics for HTTP requests, services and the database pool,
+// in a registry per app so that tests don't share counters.
+package metrics
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/routes"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        *prometheus.GaugeVec
+	serviceDuration *prometheus.HistogramVec
+	retries         *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by method, route template and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time taken to respond to HTTP requests, by method, route template and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests currently being handled, by method and route template.",
+		}, []string{"method", "route"}),
+		serviceDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "service_method_duration_seconds",
+			Help:    "Time taken by service methods, by service and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "method"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_retries_total",
+			Help: "Database operations retried after a deadlock or dropped connection, by operation e.g. connect or UserService.GetUser.",
+		}, []string{"operation"}),
+	}
+	m.Registry.MustRegister(
+		m.requests, m.requestDuration, m.inFlight, m.serviceDuration, m.retries,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Exposes the pool stats of a database, such as open and idle connections and how long callers waited for one
+func (m *Metrics) RegisterDB(db *sql.DB, name string) {
+	m.Registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// Counts and times every request once it has been handled, labelled by the template of the route set by Track
+func (m *Metrics) Middleware() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		start := time.Now()
+
+		// Errors are rendered here rather than returned, so that the status they are given can be recorded
+		if err := ctx.Next(); err != nil {
+			if err := ctx.App().ErrorHandler(ctx, err); err != nil {
+				ctx.Status(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := strconv.Itoa(ctx.Response().StatusCode())
+		labels := prometheus.Labels{"method": ctx.Method(), "route": routes.Template(ctx), "status": status}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+// Must be the first handler of every route, e.g. app.Get("/api/users", m.Track(), handler).
+// It records the route template for Middleware and tracing, and tracks the requests in progress on the route,
+// as the route isn't known until a request has been routed.
+func (m *Metrics) Track() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		route := routes.Record(ctx)
+
+		gauge := m.inFlight.With(prometheus.Labels{"method": ctx.Method(), "route": route})
+		gauge.Inc()
+		defer gauge.Dec()
+		return ctx.Next()
+	}
+}
+
+// Serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() fiber.Handler {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+	return func(ctx *fiber.Ctx) error {
+		handler(ctx.Context())
+		return nil
+	}
+}
+
+// Times a service method, e.g. defer svc.Metrics.TimeService("UserService", "GetUser")().
+// Does nothing when m is nil, so services can be used without metrics.
+func (m *Metrics) TimeService(service, method string) func() {
+	if m == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		m.serviceDuration.With(prometheus.Labels{"service": service, "method": method}).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Counts retries of a database operation. Does nothing when m is nil, so services can be used without metrics.
+func (m *Metrics) CountRetries(operation string, retries int) {
+	if m == nil {
+		return
+	}
+	m.retries.With(prometheus.Labels{"operation": operation}).Add(float64(retries))
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/auth"
+	"github.com/conormkelly/fiber-demo/models"
+	"github.com/conormkelly/fiber-demo/services"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Looks up the API key sent in an X-API-Key header
+type APIKeyVerifier interface {
+	VerifyKey(ctx context.Context, key string) (*models.APIKey, error)
+}
+
+type AuthConfig struct {
+	Keys     auth.KeySource
+	APIKeys  APIKeyVerifier        // Accepts X-API-Key headers as an alternative to bearer tokens, if set
+	Issuer   string                // Required "iss" claim, if set
+	Audience string                // Required "aud" claim, if set
+	Skip     func(*fiber.Ctx) bool // Requests that don't need to authenticate, e.g. health checks
+	Logger   *slog.Logger          // Logs why credentials were rejected, defaults to slog.Default()
+}
+
+// Returns a Skip func that matches requests for any of the given paths, in the same way the router matches them,
+// so that e.g. "/healthz/" is skipped too unless StrictRouting is set
+func SkipPaths(paths ...string) func(*fiber.Ctx) bool {
+	return func(ctx *fiber.Ctx) bool {
+		config := ctx.App().Config()
+		requested := routePath(ctx.Path(), config)
+		for _, path := range paths {
+			if requested == routePath(path, config) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Normalises a path as the router does before matching it against routes
+func routePath(path string, config fiber.Config) string {
+	if !config.StrictRouting && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
+	if !config.CaseSensitive {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// Requires a valid HS256, RS256 or EdDSA signed JWT in the Authorization header, or a valid X-API-Key header,
+// and stores the caller's claims in the request's locals under auth.ClaimsKey.
+func Authenticate(config AuthConfig) fiber.Handler {
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}))
+
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		if config.Keys == nil {
+			return nil, auth.ErrUnknownKey
+		}
+		kid, _ := token.Header["kid"].(string)
+		return config.Keys.Key(token.Method.Alg(), kid)
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return func(ctx *fiber.Ctx) error {
+		if config.Skip != nil && config.Skip(ctx) {
+			return ctx.Next()
+		}
+
+		if key := ctx.Get(HeaderAPIKey); key != "" && config.APIKeys != nil {
+			return authenticateAPIKey(ctx, config.APIKeys, logger, key)
+		}
+
+		scheme, tokenString, _ := strings.Cut(ctx.Get(fiber.HeaderAuthorization), " ")
+		if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(tokenString) == "" {
+			return unauthorized(ctx, "missing bearer token")
+		}
+
+		claims := &auth.Claims{}
+		_, err := parser.ParseWithClaims(strings.TrimSpace(tokenString), claims, keyFunc)
+		if err == nil {
+			err = verifyClaims(claims, &config)
+		}
+		if err != nil {
+			// The reason is only logged, to avoid helping anyone probe for valid tokens
+			logger.InfoContext(ctx.UserContext(), "Rejected bearer token.", "error", err)
+			return unauthorized(ctx, "invalid bearer token")
+		}
+
+		ctx.Locals(auth.ClaimsKey, claims)
+		return ctx.Next()
+	}
+}
+
+const HeaderAPIKey = "X-API-Key"
+
+func authenticateAPIKey(ctx *fiber.Ctx, verifier APIKeyVerifier, logger *slog.Logger, key string) error {
+	apiKey, err := verifier.VerifyKey(ctx.UserContext(), key)
+	if errors.Is(err, services.ErrInvalidAPIKey) {
+		logger.InfoContext(ctx.UserContext(), "Rejected API key.", "error", err)
+		return apperrors.New(apperrors.InvalidAPIKey, "invalid API key")
+	} else if err != nil {
+		return err
+	}
+
+	ctx.Locals(auth.ClaimsKey, &auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "key:" + strconv.FormatUint(uint64(apiKey.ID), 10)},
+		Scopes:           apiKey.Scopes,
+	})
+	return ctx.Next()
+}
+
+// Treats every request as made by the given caller, for when authentication is disabled
+func Impersonate(claims *auth.Claims) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		ctx.Locals(auth.ClaimsKey, claims)
+		return ctx.Next()
+	}
+}
+
+func verifyClaims(claims *auth.Claims, config *AuthConfig) error {
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if config.Issuer != "" && !claims.VerifyIssuer(config.Issuer, true) {
+		return errors.New("unexpected issuer " + claims.Issuer)
+	}
+	if config.Audience != "" && !claims.VerifyAudience(config.Audience, true) {
+		return errors.New("unexpected audience")
+	}
+	return nil
+}
+
+func unauthorized(ctx *fiber.Ctx, message string) error {
+	ctx.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="api"`)
+	return apperrors.New(apperrors.Unauthenticated, message)
+}
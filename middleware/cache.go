@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Sets the Cache-Control header on successful (200) and not modified (304) responses,
+// so that errors are never cached. An empty value leaves the header unset.
+func CacheControl(directives string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		err := ctx.Next()
+		if directives == "" || err != nil {
+			return err
+		}
+
+		status := ctx.Response().StatusCode()
+		if status == fiber.StatusOK || status == fiber.StatusNotModified {
+			ctx.Set(fiber.HeaderCacheControl, directives)
+		}
+		return nil
+	}
+}
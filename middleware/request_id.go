@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/logging"
+	"github.com/gofiber/fiber/v2"
+)
+
+const HeaderRequestID = "X-Request-ID"
+
+// Key of the request's locals holding its ID
+const RequestIDKey = "requestID"
+
+// Longest X-Request-ID accepted from clients, longer ones are replaced
+const maxRequestIDLength = 128
+
+// Reuses the client's X-Request-ID header, or generates an ID, and echoes it in the response.
+// The ID is stored in the request's locals under RequestIDKey and in its user context,
+// so that everything logged with ctx.UserContext() is tagged with it.
+func RequestID() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		requestID := ctx.Get(HeaderRequestID)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		ctx.Set(HeaderRequestID, requestID)
+		ctx.Locals(RequestIDKey, requestID)
+		ctx.SetUserContext(logging.WithRequestID(ctx.UserContext(), requestID))
+		return ctx.Next()
+	}
+}
+
+// The ID given to the request by RequestID, or "" if it wasn't used
+func RequestIDFrom(ctx *fiber.Ctx) string {
+	requestID, _ := ctx.Locals(RequestIDKey).(string)
+	return requestID
+}
+
+// Logs each request once it has been handled, with its status and duration.
+// Errors must already have been rendered, e.g. by the metrics middleware, for their status to be logged.
+func AccessLog(logger *slog.Logger) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		start := time.Now()
+		err := ctx.Next()
+
+		logger.InfoContext(ctx.UserContext(), "Handled request.",
+			"method", ctx.Method(),
+			"path", ctx.Path(),
+			"status", ctx.Response().StatusCode(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+		return err
+	}
+}
+
+// Only printable ASCII is accepted, so that IDs can't forge log lines or headers
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, char := range requestID {
+		if char < ' ' || char > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Gives the request a deadline, after which queries made with ctx.UserContext() are cancelled
+// and the request fails with an error matching context.DeadlineExceeded. A timeout of 0 sets no deadline.
+func Timeout(timeout time.Duration) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if timeout <= 0 {
+			return ctx.Next()
+		}
+
+		deadlineCtx, cancel := context.WithTimeout(ctx.UserContext(), timeout)
+		defer cancel()
+		ctx.SetUserContext(deadlineCtx)
+
+		err := ctx.Next()
+		if err == nil || errors.Is(err, context.DeadlineExceeded) || !errors.Is(deadlineCtx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+		// Drivers don't always return the context's error when a query is cancelled,
+		// but errors meant for the client, such as a 404, are kept
+		var appError *apperrors.Error
+		var fiberError *fiber.Error
+		if errors.As(err, &appError) || errors.As(err, &fiberError) {
+			return err
+		}
+		return errors.Join(context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// A column that a table created before migrations existed may be missing, with its definition for each dialect
+type adoptedColumn struct {
+	Name       string
+	Definition map[string]string
+}
+
+// Brings a table created before migrations existed, by GORM's AutoMigrate, up to the schema its migration creates,
+// as CREATE TABLE IF NOT EXISTS leaves an existing table as it is. Runs before the migration's script.
+type adoption func(tx *gorm.DB) error
+
+// Keyed by the migration creating the table, e.g. "1_create_users"
+var adoptions = map[string]adoption{
+	"1_create_users": adoptUsers,
+}
+
+// The baseline's users table only had id, created_at, first_name and last_name
+var adoptedUserColumns = []adoptedColumn{
+	{"updated_at", map[string]string{"mysql": "datetime(3) NULL", "sqlite": "datetime"}},
+	{"deleted_at", map[string]string{"mysql": "datetime(3) NULL", "sqlite": "datetime"}},
+	{"version", map[string]string{"mysql": "bigint unsigned NOT NULL DEFAULT 1", "sqlite": "integer NOT NULL DEFAULT 1"}},
+}
+
+func adoptUsers(tx *gorm.DB) error {
+	migrator := tx.Migrator()
+	if !migrator.HasTable("users") {
+		return nil
+	}
+
+	dialect := tx.Dialector.Name()
+	for _, column := range adoptedUserColumns {
+		if migrator.HasColumn("users", column.Name) {
+			continue
+		}
+		definition, ok := column.Definition[dialect]
+		if !ok {
+			return fmt.Errorf("can't adopt the users table on the %s dialect", dialect)
+		}
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE `users` ADD COLUMN `%s` %s", column.Name, definition)).Error; err != nil {
+			return fmt.Errorf("adding users.%s: %w", column.Name, err)
+		}
+	}
+	if !migrator.HasIndex("users", "idx_users_deleted_at") {
+		if err := tx.Exec("CREATE INDEX `idx_users_deleted_at` ON `users` (`deleted_at`)").Error; err != nil {
+			return err
+		}
+	}
+	// Users that were never updated were last modified when they were created
+	return tx.Exec("UPDATE `users` SET `updated_at` = `created_at` WHERE `updated_at` IS NULL").Error
+}
@@ -0,0 +1,78 @@
+package migrations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/dberrors"
+	"gorm.io/gorm"
+)
+
+// Stops concurrent starters from applying the same migrations twice
+type locker interface {
+	lock(conn *gorm.DB, timeout time.Duration) error
+	unlock(conn *gorm.DB) error
+}
+
+const lockName = "schema_migrations"
+
+func lockerFor(dialect string) locker {
+	if dialect == "mysql" {
+		return mysqlLocker{}
+	}
+	return tableLocker{}
+}
+
+// Uses MySQL's named locks, which are released automatically if the session ends
+type mysqlLocker struct{}
+
+func (mysqlLocker) lock(conn *gorm.DB, timeout time.Duration) error {
+	var acquired *int
+	if err := conn.Raw("SELECT GET_LOCK(?, ?)", lockName, int(timeout.Seconds())).Scan(&acquired).Error; err != nil {
+		return err
+	}
+	if acquired == nil || *acquired != 1 {
+		return ErrLocked
+	}
+	return nil
+}
+
+func (mysqlLocker) unlock(conn *gorm.DB) error {
+	return conn.Exec("SELECT RELEASE_LOCK(?)", lockName).Error
+}
+
+// Holds the lock by inserting the only row of a lock table, for databases without named locks e.g. SQLite.
+// A process that dies while migrating leaves the row behind, which has to be deleted by hand.
+type tableLocker struct{}
+
+const lockPollInterval = 100 * time.Millisecond
+
+func (tableLocker) lock(conn *gorm.DB, timeout time.Duration) error {
+	err := conn.Exec("CREATE TABLE IF NOT EXISTS schema_migrations_lock (id INTEGER NOT NULL PRIMARY KEY, locked_at DATETIME NOT NULL)").Error
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		// The primary key only lets one process insert the row
+		err = conn.Exec("INSERT INTO schema_migrations_lock (id, locked_at) VALUES (1, ?)", conn.NowFunc()).Error
+		if err == nil {
+			return nil
+		}
+		// Anything but the row already existing, e.g. a lost connection, isn't worth waiting on
+		if dberrors.Classify(err) != dberrors.Conflict {
+			return err
+		}
+		if time.Now().After(deadline) {
+			var lockedAt time.Time
+			conn.Raw("SELECT locked_at FROM schema_migrations_lock WHERE id = 1").Scan(&lockedAt)
+			return fmt.Errorf("%w since %s, delete the row in schema_migrations_lock if it is stale", ErrLocked, lockedAt.Format(time.RFC3339))
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func (tableLocker) unlock(conn *gorm.DB) error {
+	return conn.Exec("DELETE FROM schema_migrations_lock WHERE id = 1").Error
+}
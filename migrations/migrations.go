@@ -0,0 +1,325 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Scripts are named <version>_<name>.<up|down>.sql, in a directory per dialect.
+// Statements are separated by a semicolon at the end of a line.
+//
+//go:embed sql
+var files embed.FS
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var statementSeparator = regexp.MustCompile(`;\s*(\n|$)`)
+
+// Returned when another process holds the migration lock for longer than the LockTimeout
+var ErrLocked = errors.New("migrations are locked by another process")
+
+// How long to wait for another process to finish migrating, by default
+const DefaultLockTimeout = time.Minute
+
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// A migration, and when it was applied if it has been.
+// Migrations that were applied but are no longer known have an empty Up and Down.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Keeps track of the migrations applied to a database in its schema_migrations table
+type Migrator struct {
+	DB          *gorm.DB
+	Migrations  []Migration
+	LockTimeout time.Duration
+	locker      locker
+}
+
+type appliedMigration struct {
+	Version   uint64
+	Name      string
+	AppliedAt time.Time
+}
+
+func (appliedMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Creates a Migrator for the embedded migrations of the database's dialect
+func New(db *gorm.DB) (*Migrator, error) {
+	dialect := db.Dialector.Name()
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Migrations: migrations, LockTimeout: DefaultLockTimeout, locker: lockerFor(dialect)}, nil
+}
+
+// Reads the embedded migrations for a dialect, ordered by version
+func Load(dialect string) ([]Migration, error) {
+	dir := path.Join("sql", dialect)
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for the %s dialect", dialect)
+	}
+
+	byVersion := map[uint64]*Migration{}
+	for _, entry := range entries {
+		match := fileNamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, _ := strconv.ParseUint(match[1], 10, 64)
+		contents, err := files.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down script", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Lists every known or applied migration, ordered by version
+func (m *Migrator) Status() ([]Status, error) {
+	var statuses []Status
+	err := m.DB.Connection(func(conn *gorm.DB) error {
+		var err error
+		statuses, err = m.status(conn)
+		return err
+	})
+	return statuses, err
+}
+
+// Fails unless every known migration has been applied, e.g. so that the app isn't ready until it has been migrated
+func (m *Migrator) CheckApplied(ctx context.Context) error {
+	migrator := *m
+	migrator.DB = m.DB.WithContext(ctx)
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, fmt.Sprintf("%d_%s", status.Version, status.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("migrations are pending: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// Applies every pending migration in order, returning those that were applied
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+	err := m.withLock(func(conn *gorm.DB) error {
+		if err := ensureTable(conn); err != nil {
+			return err
+		}
+		statuses, err := m.status(conn)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.AppliedAt != nil {
+				continue
+			}
+			if err := m.apply(conn, status.Migration); err != nil {
+				return err
+			}
+			applied = append(applied, status.Migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Rolls back the latest applied migration, returning it, or nil if none have been applied
+func (m *Migrator) Down() (*Migration, error) {
+	var rolledBack *Migration
+	err := m.withLock(func(conn *gorm.DB) error {
+		var err error
+		rolledBack, err = m.rollbackLatest(conn)
+		return err
+	})
+	return rolledBack, err
+}
+
+// Rolls back and reapplies the latest applied migration, e.g. while developing it
+func (m *Migrator) Redo() (*Migration, error) {
+	var redone *Migration
+	err := m.withLock(func(conn *gorm.DB) error {
+		var err error
+		if redone, err = m.rollbackLatest(conn); err != nil || redone == nil {
+			return err
+		}
+		return m.apply(conn, *redone)
+	})
+	return redone, err
+}
+
+// Reads the applied migrations without any DDL, so that it is safe to call from readiness checks.
+// Until schema_migrations has been created by Up, nothing has been applied.
+func (m *Migrator) status(conn *gorm.DB) ([]Status, error) {
+	var applied []appliedMigration
+	if conn.Migrator().HasTable(&appliedMigration{}) {
+		if err := conn.Order("version").Find(&applied).Error; err != nil {
+			return nil, err
+		}
+	}
+	appliedAt := map[uint64]time.Time{}
+	for _, migration := range applied {
+		appliedAt[migration.Version] = migration.AppliedAt
+	}
+
+	var statuses []Status
+	for _, migration := range m.Migrations {
+		status := Status{Migration: migration}
+		if at, ok := appliedAt[migration.Version]; ok {
+			status.AppliedAt = &at
+			delete(appliedAt, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, migration := range applied {
+		if at, ok := appliedAt[migration.Version]; ok {
+			statuses = append(statuses, Status{Migration: Migration{Version: migration.Version, Name: migration.Name}, AppliedAt: &at})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+func (m *Migrator) rollbackLatest(conn *gorm.DB) (*Migration, error) {
+	statuses, err := m.status(conn)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if statuses[i].AppliedAt == nil {
+			continue
+		}
+		migration := statuses[i].Migration
+		if migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s was applied but is no longer known, so can't be rolled back", migration.Version, migration.Name)
+		}
+		if err := m.rollback(conn, migration); err != nil {
+			return nil, err
+		}
+		return &migration, nil
+	}
+	return nil, nil
+}
+
+// Runs the migration and records it in one transaction. That only makes it atomic on SQLite:
+// MySQL commits implicitly before and after each DDL statement, so a script that fails part way leaves
+// its earlier statements applied but unrecorded, and they have to be undone by hand before it is retried.
+func (m *Migrator) apply(conn *gorm.DB, migration Migration) error {
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if adopt, ok := adoptions[fmt.Sprintf("%d_%s", migration.Version, migration.Name)]; ok {
+			if err := adopt(tx); err != nil {
+				return fmt.Errorf("migration %d_%s failed to adopt an existing table: %w", migration.Version, migration.Name, err)
+			}
+		}
+		if err := execScript(tx, migration.Up); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		return tx.Create(&appliedMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+	})
+}
+
+func (m *Migrator) rollback(conn *gorm.DB, migration Migration) error {
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if err := execScript(tx, migration.Down); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		return tx.Delete(&appliedMigration{}, "version = ?", migration.Version).Error
+	})
+}
+
+// Runs the whole operation on a single connection, as MySQL's locks belong to the session that took them
+func (m *Migrator) withLock(operation func(conn *gorm.DB) error) error {
+	return m.DB.Connection(func(conn *gorm.DB) error {
+		if err := m.locker.lock(conn, m.LockTimeout); err != nil {
+			return err
+		}
+		defer m.locker.unlock(conn)
+		return operation(conn)
+	})
+}
+
+func ensureTable(conn *gorm.DB) error {
+	return conn.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		"version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at DATETIME NOT NULL)").Error
+}
+
+func execScript(tx *gorm.DB, script string) error {
+	for _, statement := range splitStatements(script) {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Splits a script on semicolons that end a line, as drivers can't be relied on to run several statements at once
+func splitStatements(script string) []string {
+	var statements []string
+	for _, statement := range statementSeparator.Split(script, -1) {
+		if statement = strings.TrimSpace(statement); statement != "" && !onlyComments(statement) {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+func onlyComments(statement string) bool {
+	for _, line := range strings.Split(statement, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
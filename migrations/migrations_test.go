@@ -0,0 +1,143 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Confirm that every dialect has a complete, ordered set of migrations
+func TestLoad(t *testing.T) {
+	for _, dialect := range []string{"mysql", "sqlite"} {
+		t.Run(fmt.Sprintf("%s - %s", t.Name(), dialect), func(t *testing.T) {
+			migrations, err := Load(dialect)
+			assert.Nil(t, err)
+			assert.NotEmpty(t, migrations)
+			for i, migration := range migrations {
+				assert.Equal(t, uint64(i+1), migration.Version, "versions are consecutive")
+				assert.NotEmpty(t, splitStatements(migration.Up))
+				assert.NotEmpty(t, splitStatements(migration.Down))
+			}
+		})
+	}
+
+	_, err := Load("postgres")
+	assert.NotNil(t, err)
+}
+
+func TestMigrator(t *testing.T) {
+	migrator, err := New(openTestDB("migrator_test"))
+	assert.Nil(t, err)
+	latest := migrator.Migrations[len(migrator.Migrations)-1]
+
+	assert.NotNil(t, migrator.CheckApplied(context.Background()), "nothing has been applied yet")
+	assert.False(t, migrator.DB.Migrator().HasTable("schema_migrations"), "checking the status doesn't run DDL")
+
+	applied, err := migrator.Up()
+	assert.Nil(t, err)
+	assert.Equal(t, migrator.Migrations, applied)
+	assert.Nil(t, migrator.CheckApplied(context.Background()))
+
+	applied, err = migrator.Up()
+	assert.Nil(t, err)
+	assert.Empty(t, applied, "applied migrations are skipped")
+
+	rolledBack, err := migrator.Down()
+	assert.Nil(t, err)
+	assert.Equal(t, latest.Version, rolledBack.Version)
+
+	statuses, err := migrator.Status()
+	assert.Nil(t, err)
+	assert.Len(t, statuses, len(migrator.Migrations))
+	for _, status := range statuses {
+		assert.Equal(t, status.Version != latest.Version, status.AppliedAt != nil, "only the latest migration is pending")
+	}
+	assert.EqualError(t, migrator.CheckApplied(context.Background()), fmt.Sprintf("migrations are pending: %d_%s", latest.Version, latest.Name))
+
+	redone, err := migrator.Redo()
+	assert.Nil(t, err)
+	assert.Equal(t, migrator.Migrations[len(migrator.Migrations)-2].Version, redone.Version, "redo acts on the latest applied migration")
+
+	// Roll everything back
+	for {
+		migration, err := migrator.Down()
+		assert.Nil(t, err)
+		if migration == nil {
+			break
+		}
+	}
+	assert.False(t, migrator.DB.Migrator().HasTable("users"))
+}
+
+// Confirm that a users table created by the baseline's AutoMigrate is given the columns the migrations add
+func TestAdoptUsers(t *testing.T) {
+	db := openTestDB("migrator_adopt_test")
+	err := db.Exec("CREATE TABLE `users` (`id` integer, `created_at` datetime, `first_name` text, `last_name` text, PRIMARY KEY (`id`))").Error
+	assert.Nil(t, err)
+	createdAt := time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, db.Exec("INSERT INTO `users` (`created_at`, `first_name`, `last_name`) VALUES (?, 'John', 'Doe')", createdAt).Error)
+
+	migrator, _ := New(db)
+	_, err = migrator.Up()
+	assert.Nil(t, err)
+
+	for _, column := range []string{"updated_at", "deleted_at", "version"} {
+		assert.True(t, db.Migrator().HasColumn("users", column), column)
+	}
+	assert.True(t, db.Migrator().HasIndex("users", "idx_users_deleted_at"))
+
+	var user struct {
+		Version   uint
+		UpdatedAt time.Time
+		DeletedAt *time.Time
+	}
+	assert.Nil(t, db.Table("users").Where("id = 1").Scan(&user).Error)
+	assert.Equal(t, uint(1), user.Version)
+	assert.True(t, createdAt.Equal(user.UpdatedAt), "updated_at is backfilled from created_at")
+	assert.Nil(t, user.DeletedAt)
+}
+
+func TestMigratorLock(t *testing.T) {
+	db := openTestDB("migrator_lock_test")
+	migrator, _ := New(db)
+	migrator.LockTimeout = 200 * time.Millisecond
+
+	// Another process holds the lock
+	assert.Nil(t, migrator.locker.lock(db, 0))
+
+	_, err := migrator.Up()
+	assert.True(t, errors.Is(err, ErrLocked), "got %v", err)
+
+	assert.Nil(t, migrator.locker.unlock(db))
+	_, err = migrator.Up()
+	assert.Nil(t, err)
+
+	// Failing to insert the row for any other reason is returned straight away, rather than reported as locked
+	db.Exec("DROP TABLE schema_migrations_lock")
+	db.Exec("CREATE TABLE schema_migrations_lock (id INTEGER NOT NULL PRIMARY KEY, locked_at DATETIME NOT NULL, holder TEXT NOT NULL)")
+	start := time.Now()
+	err = migrator.locker.lock(db, time.Minute)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrLocked), "got %v", err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := "-- A comment\nCREATE TABLE a (b TEXT DEFAULT ';');\nCREATE INDEX c ON a(b);\n\n-- Trailing comment\n"
+	assert.Equal(t, []string{"-- A comment\nCREATE TABLE a (b TEXT DEFAULT ';')", "CREATE INDEX c ON a(b)"}, splitStatements(script))
+}
+
+func openTestDB(name string) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	return db
+}
@@ -0,0 +1,12 @@
+-- IF NOT EXISTS adopts tables previously created by GORM's AutoMigrate, whose missing columns are added by adoptUsers
+CREATE TABLE IF NOT EXISTS `users` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `deleted_at` datetime(3) NULL,
+  `version` bigint unsigned NOT NULL DEFAULT 1,
+  `first_name` longtext,
+  `last_name` longtext,
+  PRIMARY KEY (`id`),
+  INDEX `idx_users_deleted_at` (`deleted_at`)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `api_keys` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` datetime(3) NULL,
+  `updated_at` datetime(3) NULL,
+  `name` longtext,
+  `prefix` varchar(32),
+  `hash` varchar(64),
+  `scopes` longtext,
+  `expires_at` datetime(3) NULL,
+  `last_used_at` datetime(3) NULL,
+  `created_by` longtext,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `idx_api_keys_prefix` (`prefix`)
+);
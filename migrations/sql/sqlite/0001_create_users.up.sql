@@ -0,0 +1,12 @@
+-- IF NOT EXISTS adopts tables previously created by GORM's AutoMigrate, whose missing columns are added by adoptUsers
+CREATE TABLE IF NOT EXISTS `users` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `deleted_at` datetime,
+  `version` integer NOT NULL DEFAULT 1,
+  `first_name` text,
+  `last_name` text,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_users_deleted_at` ON `users`(`deleted_at`);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `api_keys` (
+  `id` integer,
+  `created_at` datetime,
+  `updated_at` datetime,
+  `name` text,
+  `prefix` text,
+  `hash` text,
+  `scopes` text,
+  `expires_at` datetime,
+  `last_used_at` datetime,
+  `created_by` text,
+  PRIMARY KEY (`id`)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_api_keys_prefix` ON `api_keys`(`prefix`);
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix" gorm:"size:32;uniqueIndex"` // The non-secret start of the key, used to look it up
+	Hash       string     `json:"-" gorm:"size:64"`                  // Hex SHA-256 of the whole key, which is never stored
+	Scopes     []string   `json:"scopes" gorm:"serializer:json"`     // Actions the key may perform
+	ExpiresAt  *time.Time `json:"expires_at"`                        // Never expires if nil
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedBy  string     `json:"created_by"` // Subject of the caller that issued the key
+}
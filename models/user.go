@@ -2,11 +2,16 @@ package models
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type User struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	CreatedAt time.Time `json:"created_at"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"deleted_at" gorm:"index"`           // Soft delete, GORM excludes these rows unless Unscoped
+	Version   uint           `json:"version" gorm:"not null;default:1"` // Incremented on every write, for optimistic locking
+	FirstName string         `json:"first_name"`
+	LastName  string         `json:"last_name"`
 }
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/config"
+	"github.com/conormkelly/fiber-demo/database"
+	"github.com/conormkelly/fiber-demo/logging"
+	"github.com/conormkelly/fiber-demo/tracing"
+	"github.com/hashicorp/go-multierror"
+)
+
+// Settings are named by their config tag, see the config package for how they are read
+type Options struct {
+	ConnectionString         config.Secret     `config:"db.conn_string"`              // The DSN for the DB e.g. "user:password@tcp(localhost:3306)/go_app" or "sqlite://data/app.db"
+	DBHost                   string            `config:"db.host"`                     // MySQL host and optional port, used with the other parts instead of ConnectionString
+	DBUser                   string            `config:"db.user"`                     // MySQL user
+	DBPassword               config.Secret     `config:"db.password"`                 // MySQL password
+	DBName                   string            `config:"db.name"`                     // MySQL database name
+	DBDriver                 string            `config:"db.driver"`                   // mysql, sqlite or memory, only needed when ConnectionString has no URL scheme
+	ShouldAutoMigrate        bool              `config:"run_auto_migrate"`            // Applies pending migrations on startup
+	Port                     string            `config:"port"`                        // Address to listen on e.g. ":3000"
+	ShutdownTimeout          time.Duration     `config:"shutdown_timeout"`            // How long to wait for requests in progress to finish when shutting down
+	ShutdownDelay            time.Duration     `config:"shutdown_delay"`              // How long to keep serving, while failing readiness checks, before shutting down
+	CursorSecret             config.Secret     `config:"cursor_secret"`               // Key used to sign pagination cursors
+	CacheControl             map[string]string `config:"cache_control"`               // Cache-Control header for each cacheable route, keyed by route name
+	RequestTimeout           time.Duration     `config:"request_timeout"`             // Deadline of each request's queries, unless overridden in Timeouts, 0 sets none
+	Timeouts                 map[string]string `config:"timeouts"`                    // Durations overriding RequestTimeout, keyed by route name e.g. "users.list"
+	AuthDisabled             bool              `config:"auth_disabled"`               // Skips authentication entirely, for local development only
+	JWTSecret                config.Secret     `config:"jwt.secret"`                  // Shared secret for HS256 tokens
+	JWTKeysFile              string            `config:"jwt.keys_file"`               // PEM or JWKS file of RS256 / EdDSA public keys
+	JWTKeysRefresh           time.Duration     `config:"jwt.keys_refresh"`            // How often JWTKeysFile is checked for rotated keys
+	JWTIssuer                string            `config:"jwt.issuer"`                  // Required "iss" claim, if set
+	JWTAudience              string            `config:"jwt.audience"`                // Required "aud" claim, if set
+	PolicyFile               string            `config:"policy_file"`                 // JSON file of access rules overriding auth.DefaultPolicy
+	MetricsPublic            bool              `config:"metrics_public"`              // Serves /metrics without authentication, e.g. to scrapers on a private network
+	LegacyErrors             bool              `config:"legacy_errors"`               // Renders errors as {"message": ...} rather than application/problem+json, for older clients
+	LogLevel                 string            `config:"log.level"`                   // debug, info, warn or error
+	LogFormat                string            `config:"log.format"`                  // json or text
+	DBLogLevel               string            `config:"db.log_level"`                // Level of GORM's logs: silent, error, warn or info, which logs every query
+	DBSlowThreshold          time.Duration     `config:"db.slow_threshold"`           // Queries taking longer are logged as slow, 0 disables this
+	DBConnectRetries         int               `config:"db.connect_retries"`          // Retries connecting on startup while the DB can't be reached, 0 for none
+	DBConnectBackoff         time.Duration     `config:"db.connect_backoff"`          // Most waited before the first connection retry, doubling for each one after it
+	DBConnectMaxBackoff      time.Duration     `config:"db.connect_max_backoff"`      // Caps the doubling of DBConnectBackoff
+	DBRetries                int               `config:"db.retries"`                  // Retries of read-only service calls on deadlocks and dropped connections, 0 for none
+	DBRetryBackoff           time.Duration     `config:"db.retry_backoff"`            // Most waited before the first retry of a call, doubling for each one after it
+	DBRetryMaxBackoff        time.Duration     `config:"db.retry_max_backoff"`        // Caps the doubling of DBRetryBackoff
+	DBMaxOpenConns           int               `config:"db.max_open_conns"`           // Limits the connections open at once, unlimited if 0
+	DBMaxIdleConns           int               `config:"db.max_idle_conns"`           // Idle connections kept for reuse, database/sql's default of 2 if 0
+	DBConnMaxLifetime        time.Duration     `config:"db.conn_max_lifetime"`        // Connections are closed once this old, never if 0
+	DBConnMaxIdleTime        time.Duration     `config:"db.conn_max_idle_time"`       // Connections are closed once idle for this long, never if 0
+	DBPrepareStmt            bool              `config:"db.prepare_stmt"`             // Prepares each distinct query once per connection and reuses it
+	DBSkipDefaultTransaction bool              `config:"db.skip_default_transaction"` // Doesn't wrap single writes in a transaction
+	TracingExporter          string            `config:"tracing.exporter"`            // none, otlp, stdout or file
+	TracingEndpoint          string            `config:"tracing.endpoint"`            // OTLP/HTTP endpoint e.g. "http://localhost:4318", otherwise read from OTEL_EXPORTER_OTLP_ENDPOINT
+	TracingFile              string            `config:"tracing.file"`                // File the file exporter appends spans to
+	TracingSampleRatio       float64           `config:"tracing.sample_ratio"`        // Fraction of traces recorded, unless the caller already decided
+	TracingServiceName       string            `config:"tracing.service_name"`        // Reported as service.name
+}
+
+// The config file and secrets directory can each be set with an environment variable or a flag, the flag taking precedence
+const (
+	configFileEnv  = "APP_CONFIG_FILE"
+	configFileFlag = "config"
+	secretsDirEnv  = "APP_SECRETS_DIR"
+	secretsDirFlag = "secrets-dir"
+)
+
+func defaultOptions() *Options {
+	options := &Options{
+		JWTKeysRefresh:      time.Minute,
+		ShutdownTimeout:     30 * time.Second,
+		LogLevel:            "info",
+		LogFormat:           "json",
+		DBLogLevel:          "warn",
+		DBSlowThreshold:     200 * time.Millisecond,
+		DBConnectRetries:    10,
+		DBConnectBackoff:    500 * time.Millisecond,
+		DBConnectMaxBackoff: 10 * time.Second,
+		DBRetries:           2,
+		DBRetryBackoff:      50 * time.Millisecond,
+		DBRetryMaxBackoff:   time.Second,
+		DBMaxIdleConns:      2,
+		TracingExporter:     tracing.None,
+		TracingSampleRatio:  1,
+		TracingServiceName:  "fiber-demo",
+		CacheControl:        map[string]string{},
+		RequestTimeout:      10 * time.Second,
+		Timeouts:            map[string]string{},
+	}
+	for route, directives := range defaultCacheControl {
+		options.CacheControl[route] = directives
+	}
+	// Empty until set, so that every route's timeout can be read from the environment
+	for _, route := range timedRoutes {
+		options.Timeouts[route] = ""
+	}
+	return options
+}
+
+// Registers the -config and -secrets-dir flags, and a flag for every setting e.g. -port and -jwt-keys-refresh
+func RegisterOptionFlags(flags *flag.FlagSet) {
+	flags.String(configFileFlag, "", "YAML, TOML or JSON config file, overrides "+configFileEnv)
+	flags.String(secretsDirFlag, "", "Directory of secret files e.g. /run/secrets, overrides "+secretsDirEnv)
+	config.RegisterFlags(flags, &Options{})
+}
+
+// Parse environment variable config into Options, and check that it is complete enough to serve the API
+func GetAppOptions() (*Options, error) {
+	return LoadAppOptions(nil)
+}
+
+// Load Options from the defaults, config file, environment variables and flags, in increasing precedence,
+// and check that they are complete enough to serve the API. flags may be nil.
+func LoadAppOptions(flags *flag.FlagSet) (*Options, error) {
+	options, _, configErrors := loadAppOptions(flags)
+	if err := options.validateDB(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if err := options.validatePool(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if err := options.validateRetries(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if err := options.validateLogging(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if err := options.validateTracing(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if err := options.validateServe(); err != nil {
+		configErrors = multierror.Append(configErrors, err)
+	}
+	return options, configErrors
+}
+
+// Load Options from every layer, only failing on malformed values
+func loadAppOptions(flags *flag.FlagSet) (*Options, config.Sources, error) {
+	options := defaultOptions()
+
+	sources, configErrors := config.Load(options, config.Layers{
+		File:       envOrFlag(flags, configFileEnv, configFileFlag),
+		SecretsDir: envOrFlag(flags, secretsDirEnv, secretsDirFlag),
+		Flags:      flags,
+	})
+
+	// Without a configured secret, cursors are only valid until the app restarts
+	if options.CursorSecret == "" {
+		cursorSecret := make([]byte, 32)
+		if _, err := rand.Read(cursorSecret); err != nil {
+			configErrors = multierror.Append(configErrors, err)
+		}
+		options.CursorSecret = config.Secret(cursorSecret)
+	}
+
+	return options, sources, configErrors
+}
+
+// The flag's value if it was passed, otherwise the environment variable's
+func envOrFlag(flags *flag.FlagSet, env, flagName string) string {
+	if flags != nil {
+		if passed := flags.Lookup(flagName); passed != nil && passed.Value.String() != "" {
+			return passed.Value.String()
+		}
+	}
+	return os.Getenv(env)
+}
+
+// The configured connection string, or one built from its parts
+func (options *Options) connectionString() config.Secret {
+	if options.ConnectionString == "" && options.DBHost != "" {
+		credentials := database.Credentials{Host: options.DBHost, User: options.DBUser, Password: options.DBPassword, Name: options.DBName}
+		return credentials.ConnectionString()
+	}
+	return options.ConnectionString
+}
+
+// Checks the config needed by anything that uses the DB
+func (options *Options) validateDB() error {
+	usesParts := options.DBHost != "" || options.DBUser != "" || options.DBPassword != "" || options.DBName != ""
+	switch {
+	case options.ConnectionString != "" && usesParts:
+		return errors.New("APP_DB_CONN_STRING can't be combined with APP_DB_HOST, APP_DB_USER, APP_DB_PASSWORD or APP_DB_NAME")
+	case usesParts && (options.DBHost == "" || options.DBUser == "" || options.DBName == ""):
+		return errors.New("APP_DB_HOST, APP_DB_USER and APP_DB_NAME are all required when APP_DB_CONN_STRING isn't set")
+	case usesParts && options.DBDriver != "" && options.DBDriver != "mysql":
+		return errors.New("APP_DB_HOST, APP_DB_USER, APP_DB_PASSWORD and APP_DB_NAME are only supported by the mysql driver")
+	case !usesParts && options.ConnectionString == "":
+		return errors.New("APP_DB_CONN_STRING is required")
+	}
+	if err := database.CheckConnectionString(options.DBDriver, options.connectionString().Value()); err != nil {
+		if usesParts {
+			return errors.New("APP_DB_HOST, APP_DB_USER, APP_DB_PASSWORD or APP_DB_NAME is invalid - " + err.Error())
+		}
+		return errors.New("APP_DB_CONN_STRING is invalid - " + err.Error())
+	}
+	return nil
+}
+
+// Checks the sizes and lifetimes of the DB's connection pool
+func (options *Options) validatePool() error {
+	var configErrors error
+	if options.DBMaxOpenConns < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_MAX_OPEN_CONNS must not be negative"))
+	}
+	if options.DBMaxIdleConns < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_MAX_IDLE_CONNS must not be negative"))
+	}
+	if options.DBConnMaxLifetime < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_CONN_MAX_LIFETIME must not be negative"))
+	}
+	if options.DBConnMaxIdleTime < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_CONN_MAX_IDLE_TIME must not be negative"))
+	}
+	// A memory database is lost as soon as its last connection is closed
+	isMemory := options.DBDriver == "memory" || strings.HasPrefix(options.connectionString().Value(), "memory://")
+	if isMemory && (options.DBConnMaxLifetime != 0 || options.DBConnMaxIdleTime != 0) {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_CONN_MAX_LIFETIME and APP_DB_CONN_MAX_IDLE_TIME can't be used with memory databases"))
+	}
+	return configErrors
+}
+
+// Checks the retries of connecting to the DB and of service calls
+func (options *Options) validateRetries() error {
+	var configErrors error
+	if options.DBConnectRetries < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_CONNECT_RETRIES must not be negative"))
+	}
+	if options.DBRetries < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_RETRIES must not be negative"))
+	}
+	backoffs := []struct {
+		env   string
+		value time.Duration
+	}{
+		{"APP_DB_CONNECT_BACKOFF", options.DBConnectBackoff},
+		{"APP_DB_CONNECT_MAX_BACKOFF", options.DBConnectMaxBackoff},
+		{"APP_DB_RETRY_BACKOFF", options.DBRetryBackoff},
+		{"APP_DB_RETRY_MAX_BACKOFF", options.DBRetryMaxBackoff},
+	}
+	for _, backoff := range backoffs {
+		if backoff.value < 0 {
+			configErrors = multierror.Append(configErrors, errors.New(backoff.env+" must not be negative"))
+		}
+	}
+	return configErrors
+}
+
+// How to retry connecting to the DB on startup
+func (options *Options) connectRetry() database.Retry {
+	return database.Retry{Attempts: options.DBConnectRetries, BaseDelay: options.DBConnectBackoff, MaxDelay: options.DBConnectMaxBackoff}
+}
+
+// How to retry read-only service calls
+func (options *Options) retry() database.Retry {
+	return database.Retry{Attempts: options.DBRetries, BaseDelay: options.DBRetryBackoff, MaxDelay: options.DBRetryMaxBackoff}
+}
+
+// Checks the app's and GORM's log settings
+func (options *Options) validateLogging() error {
+	var configErrors error
+	if _, err := logging.ParseLevel(options.LogLevel); err != nil {
+		configErrors = multierror.Append(configErrors, errors.New("APP_LOG_LEVEL must be debug, info, warn or error"))
+	}
+	if _, err := logging.New(io.Discard, options.LogFormat, slog.LevelInfo); err != nil {
+		configErrors = multierror.Append(configErrors, errors.New("APP_LOG_FORMAT must be json or text"))
+	}
+	if _, err := database.ParseLogLevel(options.DBLogLevel); err != nil {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_LOG_LEVEL must be silent, error, warn or info"))
+	}
+	if options.DBSlowThreshold < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_DB_SLOW_THRESHOLD must not be negative"))
+	}
+	return configErrors
+}
+
+// Checks the exporter and sampling of traces
+func (options *Options) validateTracing() error {
+	var configErrors error
+	switch options.TracingExporter {
+	case tracing.None, tracing.OTLP, tracing.Stdout:
+	case tracing.File:
+		if options.TracingFile == "" {
+			configErrors = multierror.Append(configErrors, errors.New("APP_TRACING_FILE is required when APP_TRACING_EXPORTER=file"))
+		}
+	default:
+		configErrors = multierror.Append(configErrors, errors.New("APP_TRACING_EXPORTER must be none, otlp, stdout or file"))
+	}
+	if options.TracingSampleRatio < 0 || options.TracingSampleRatio > 1 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_TRACING_SAMPLE_RATIO must be between 0 and 1"))
+	}
+	return configErrors
+}
+
+// The tracing options for the tracing package
+func (options *Options) tracing() tracing.Options {
+	return tracing.Options{
+		Exporter:    options.TracingExporter,
+		Endpoint:    options.TracingEndpoint,
+		File:        options.TracingFile,
+		ServiceName: options.TracingServiceName,
+		SampleRatio: options.TracingSampleRatio,
+	}
+}
+
+// Creates the logger configured by APP_LOG_LEVEL and APP_LOG_FORMAT
+func (options *Options) logger(out io.Writer) (*slog.Logger, error) {
+	level, err := logging.ParseLevel(options.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	return logging.New(out, options.LogFormat, level)
+}
+
+// Checks the config that is only needed to serve the API
+func (options *Options) validateServe() error {
+	var configErrors error
+	if options.Port == "" {
+		configErrors = multierror.Append(configErrors, errors.New("APP_PORT is required"))
+	} else if !isListenAddress(options.Port) {
+		configErrors = multierror.Append(configErrors, errors.New("APP_PORT must be an address to listen on e.g. :3000"))
+	}
+	if options.ShutdownTimeout <= 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_SHUTDOWN_TIMEOUT must be positive"))
+	}
+	if options.RequestTimeout < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_REQUEST_TIMEOUT must not be negative"))
+	}
+	routes := make([]string, 0, len(options.Timeouts))
+	for route := range options.Timeouts {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		timeout := options.Timeouts[route]
+		if timeout == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(timeout); err != nil || parsed < 0 {
+			env := config.EnvName("timeouts." + route)
+			configErrors = multierror.Append(configErrors, errors.New(env+" must be a duration e.g. 5s"))
+		}
+	}
+	if options.ShutdownDelay < 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_SHUTDOWN_DELAY must not be negative"))
+	}
+	if !options.AuthDisabled && options.JWTSecret == "" && options.JWTKeysFile == "" {
+		err := errors.New("APP_JWT_SECRET or APP_JWT_KEYS_FILE is required, unless APP_AUTH_DISABLED=true")
+		configErrors = multierror.Append(configErrors, err)
+	}
+	if options.JWTKeysRefresh <= 0 {
+		configErrors = multierror.Append(configErrors, errors.New("APP_JWT_KEYS_REFRESH must be positive"))
+	}
+	return configErrors
+}
+
+// The deadline of a route's requests, from Timeouts or otherwise RequestTimeout
+func (options *Options) timeout(route string) time.Duration {
+	if timeout, err := time.ParseDuration(options.Timeouts[route]); err == nil {
+		return timeout
+	}
+	return options.RequestTimeout
+}
+
+// e.g. ":3000" or "127.0.0.1:3000"
+func isListenAddress(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	number, err := strconv.Atoi(port)
+	return err == nil && number > 0 && number < 65536
+}
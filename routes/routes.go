@@ -0,0 +1,28 @@
+// Package routes records the template of the route a request was matched to, so that metrics and traces
+// label requests the same way.
+package routes
+
+import "github.com/gofiber/fiber/v2"
+
+// Used as the route of requests that were answered before being routed, e.g. 404s and failed authentication,
+// so that scanners probing random paths can't create new series or span names
+const Unmatched = "unmatched"
+
+// Key of the request's locals holding its route template
+const localsKey = "routes.template"
+
+// Records the template of the route the request was matched to, e.g. /api/users/:id, and returns it.
+// Must be called from a handler of the route, as the route isn't known until a request has been routed.
+func Record(ctx *fiber.Ctx) string {
+	template := ctx.Route().Path
+	ctx.Locals(localsKey, template)
+	return template
+}
+
+// The template of the request's route, as recorded by Record, or Unmatched
+func Template(ctx *fiber.Ctx) string {
+	if template, ok := ctx.Locals(localsKey).(string); ok {
+		return template
+	}
+	return Unmatched
+}
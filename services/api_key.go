@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/database"
+	"github.com/conormkelly/fiber-demo/metrics"
+	"github.com/conormkelly/fiber-demo/models"
+	"gorm.io/gorm"
+)
+
+// Keys look like "key_<prefix>_<secret>", where only the prefix is stored in the clear
+const apiKeyScheme = "key"
+
+// How stale LastUsedAt may get, to avoid writing on every request made with a key
+const apiKeyLastUsedResolution = time.Minute
+
+// Wrapped with the reason a key was rejected, which is only meant for logs
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+type APIKeyService struct {
+	DB      *database.Database
+	Logger  *slog.Logger     // Defaults to slog.Default()
+	Metrics *metrics.Metrics // Counts retries, if set
+	Retry   database.Retry   // Retries of listing keys, on deadlocks and dropped connections
+}
+
+// Issues a new key, returning it alongside its record. The key itself is never stored, so can't be retrieved again.
+func (svc *APIKeyService) CreateKey(ctx context.Context, name string, scopes []string, expiresAt *time.Time, createdBy string) (*models.APIKey, string, error) {
+	// The prefix is hex so that it can't contain the "_" separator
+	prefixBytes := make([]byte, 6)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return nil, "", err
+	}
+	prefix := hex.EncodeToString(prefixBytes)
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	key := strings.Join([]string{apiKeyScheme, prefix, secret}, "_")
+
+	// Stored in UTC like every other timestamp, whatever offset the client sent
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+
+	apiKey := &models.APIKey{
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hashAPIKey(key),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedBy: createdBy,
+	}
+	err = svc.DB.Conn.WithContext(ctx).Create(apiKey).Error
+	if err != nil {
+		return nil, "", dbError(err)
+	}
+	loggerOrDefault(svc.Logger).InfoContext(ctx, "API key created.", "key_id", apiKey.ID, "prefix", prefix, "created_by", createdBy)
+	return apiKey, key, nil
+}
+
+func (svc *APIKeyService) GetAllKeys(ctx context.Context) ([]models.APIKey, error) {
+	keys := []models.APIKey{}
+	err := retry(ctx, svc.Retry, svc.Logger, svc.Metrics, "APIKeyService.GetAllKeys", func() error {
+		return dbError(svc.DB.Conn.WithContext(ctx).Order("id").Find(&keys).Error)
+	})
+	return keys, err
+}
+
+// Revokes a key, taking effect on the next request made with it
+func (svc *APIKeyService) DeleteKey(ctx context.Context, id int) error {
+	result := svc.DB.Conn.WithContext(ctx).Delete(&models.APIKey{}, id)
+	if result.Error != nil {
+		return dbError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return apperrors.New(apperrors.APIKeyNotFound, "API key does not exist")
+	}
+	loggerOrDefault(svc.Logger).InfoContext(ctx, "API key deleted.", "key_id", id)
+	return nil
+}
+
+// Returns the record of a valid, unexpired key and records that it was used.
+// Rejected keys return an error wrapping ErrInvalidAPIKey.
+func (svc *APIKeyService) VerifyKey(ctx context.Context, key string) (*models.APIKey, error) {
+	scheme, rest, _ := strings.Cut(key, "_")
+	prefix, _, _ := strings.Cut(rest, "_")
+	if scheme != apiKeyScheme || prefix == "" {
+		return nil, fmt.Errorf("%w: malformed key", ErrInvalidAPIKey)
+	}
+
+	apiKey := &models.APIKey{}
+	err := svc.DB.Conn.WithContext(ctx).Where("prefix = ?", prefix).First(apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: unknown prefix %s", ErrInvalidAPIKey, prefix)
+	} else if err != nil {
+		return nil, dbError(err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(apiKey.Hash)) != 1 {
+		return nil, fmt.Errorf("%w: wrong secret for prefix %s", ErrInvalidAPIKey, prefix)
+	}
+
+	now := svc.DB.Conn.NowFunc()
+	if apiKey.ExpiresAt != nil && !now.Before(*apiKey.ExpiresAt) {
+		return nil, fmt.Errorf("%w: key %d expired at %s", ErrInvalidAPIKey, apiKey.ID, apiKey.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyLastUsedResolution {
+		// UpdateColumn leaves UpdatedAt alone, as using a key doesn't modify it
+		err = svc.DB.Conn.WithContext(ctx).Model(apiKey).UpdateColumn("last_used_at", now).Error
+		if err != nil {
+			return nil, dbError(err)
+		}
+		apiKey.LastUsedAt = &now
+	}
+
+	return apiKey, nil
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns n random bytes, base64url encoded without padding
+func randomString(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyAPIKey(t *testing.T) {
+	conn, err := openTestDB("memory://api_key_test")
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	migrate(conn)
+	keyService := &APIKeyService{DB: &database.Database{Conn: conn}}
+
+	apiKey, key, err := keyService.CreateKey(context.Background(), "reporting", []string{"users:list"}, nil, "1")
+	assert.Nil(t, err)
+	assert.NotContains(t, apiKey.Hash, key, "only a hash of the key is stored")
+
+	verified, err := keyService.VerifyKey(context.Background(), key)
+	assert.Nil(t, err)
+	assert.Equal(t, apiKey.ID, verified.ID)
+	assert.Equal(t, []string{"users:list"}, verified.Scopes)
+	assert.NotNil(t, verified.LastUsedAt)
+
+	wrongSecret := key[:len(key)-1] + "x"
+	if wrongSecret == key {
+		wrongSecret = key[:len(key)-1] + "y"
+	}
+
+	past := time.Now().Add(-time.Minute)
+	_, expiredKey, _ := keyService.CreateKey(context.Background(), "expired", []string{"users:list"}, &past, "1")
+
+	for description, invalidKey := range map[string]string{
+		"malformed key":  "not-a-key",
+		"unknown prefix": "key_000000000000_secret",
+		"wrong secret":   wrongSecret,
+		"expired key":    expiredKey,
+	} {
+		_, err := keyService.VerifyKey(context.Background(), invalidKey)
+		assert.Truef(t, errors.Is(err, ErrInvalidAPIKey), "%s - got %v", description, err)
+	}
+
+	assert.Nil(t, keyService.DeleteKey(context.Background(), int(apiKey.ID)))
+	_, err = keyService.VerifyKey(context.Background(), key)
+	assert.ErrorIs(t, err, ErrInvalidAPIKey, "deleted keys are revoked")
+	assert.Equal(t, "API key does not exist", keyService.DeleteKey(context.Background(), int(apiKey.ID)).Error())
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/database"
+	"github.com/conormkelly/fiber-demo/dberrors"
+	"github.com/conormkelly/fiber-demo/metrics"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// Starts a span for a service method, as a child of any span in ctx, e.g. the request's.
+// Records nothing when tracer is nil, so services can be used without tracing.
+func startSpan(ctx context.Context, tracer trace.Tracer, name string) (context.Context, trace.Span) {
+	if tracer == nil {
+		return ctx, noop.Span{}
+	}
+	return tracer.Start(ctx, name)
+}
+
+// How long clients are asked to wait before retrying when the database is unavailable
+const retryAfter = time.Second
+
+// Gives the database errors that clients can act on a code, e.g. a duplicate key becomes CONFLICT.
+// Any other error, including nil, is returned as is, and so becomes INTERNAL_ERROR.
+func dbError(err error) error {
+	switch dberrors.Classify(err) {
+	case dberrors.Conflict:
+		return apperrors.Wrap(apperrors.Conflict, "the request conflicts with existing data", err)
+	case dberrors.InvalidInput:
+		return apperrors.Wrap(apperrors.InvalidInput, "a value was rejected by the database", err)
+	case dberrors.Retryable:
+		appError := apperrors.Wrap(apperrors.DatabaseUnavailable, "the database is temporarily unavailable, please retry", err)
+		appError.RetryAfter = retryAfter
+		return appError
+	}
+	return err
+}
+
+// Runs an idempotent database call, retrying it on deadlocks and dropped connections as set by policy.
+// Each retry is logged and counted under the operation e.g. "UserService.GetUser".
+func retry(ctx context.Context, policy database.Retry, logger *slog.Logger, m *metrics.Metrics, operation string, call func() error) error {
+	return policy.Do(ctx, call, func(attempt int, delay time.Duration, err error) {
+		loggerOrDefault(logger).WarnContext(ctx, "Retrying database call.", "operation", operation, "attempt", attempt, "delay", delay, "error", err)
+		m.CountRetries(operation, 1)
+	})
+}
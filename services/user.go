@@ -1,62 +1,274 @@
 package services
 
 import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
 	"github.com/conormkelly/fiber-demo/database"
+	"github.com/conormkelly/fiber-demo/metrics"
 	"github.com/conormkelly/fiber-demo/models"
-	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
 )
 
+var errUserModified = apperrors.New(apperrors.UserModified, "user has been modified")
+
+// Restricts a write to specific versions of a user, e.g. those listed in an If-Match header.
+// A nil *Precondition allows any version.
+type Precondition struct {
+	Versions []uint
+}
+
+func (precondition *Precondition) Allows(user *models.User) bool {
+	if precondition == nil {
+		return true
+	}
+	for _, version := range precondition.Versions {
+		if version == user.Version {
+			return true
+		}
+	}
+	return false
+}
+
 type UserService struct {
-	DB *database.Database
+	DB           *database.Database
+	CursorSecret []byte           // Key used to sign pagination cursors
+	Metrics      *metrics.Metrics // Times each method, if set
+	Logger       *slog.Logger     // Defaults to slog.Default()
+	Tracer       trace.Tracer     // Traces each method, if set
+	Retry        database.Retry   // Retries of the methods that only read, on deadlocks and dropped connections
 }
 
-func (svc *UserService) CreateUser(firstName, lastName string) (*models.User, error) {
-	user := &models.User{FirstName: firstName, LastName: lastName}
+// The DB session for a call, which cancels queries along with ctx and logs them with its request ID
+func (svc *UserService) db(ctx context.Context) *gorm.DB {
+	return svc.DB.Conn.WithContext(ctx)
+}
 
-	err := svc.DB.Conn.Create(&user).Error
-	return user, err
+// Runs a call that only reads, retrying it as set by svc.Retry
+func (svc *UserService) retry(ctx context.Context, method string, call func() error) error {
+	return retry(ctx, svc.Retry, svc.Logger, svc.Metrics, "UserService."+method, call)
 }
 
-func (svc *UserService) GetAllUsers() ([]models.User, error) {
+func (svc *UserService) CreateUser(ctx context.Context, firstName, lastName string) (*models.User, error) {
+	defer svc.Metrics.TimeService("UserService", "CreateUser")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.CreateUser")
+	defer span.End()
+
+	user := &models.User{FirstName: firstName, LastName: lastName, Version: 1}
+
+	err := svc.db(ctx).Create(&user).Error
+	if err != nil {
+		return nil, dbError(err)
+	}
+	loggerOrDefault(svc.Logger).InfoContext(ctx, "User created.", "user_id", user.ID)
+	return user, nil
+}
+
+// Returns a single page of users matching the query, along with the total number of matches
+func (svc *UserService) GetAllUsers(ctx context.Context, query *UserQuery) ([]models.User, int64, error) {
+	defer svc.Metrics.TimeService("UserService", "GetAllUsers")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.GetAllUsers")
+	defer span.End()
+
+	var total int64
 	users := []models.User{}
-	err := svc.DB.Conn.Find(&users).Error
+	err := svc.retry(ctx, "GetAllUsers", func() error {
+		err := query.filter(svc.db(ctx).Model(&models.User{})).Count(&total).Error
+		if err != nil {
+			return dbError(err)
+		}
+
+		db := query.order(query.filter(svc.db(ctx)))
+		return dbError(db.Limit(query.Limit).Offset(query.Offset).Find(&users).Error)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
 
-	return users, err
+	return users, total, nil
 }
 
-func (svc *UserService) GetUser(id int) (*models.User, error) {
-	var user models.User
-	err := svc.DB.Conn.Find(&user, "id = ?", id).Error
+// A cheap summary of the users matching a query, which changes whenever any of them do
+type UsersStamp struct {
+	Count       int64
+	LastUpdated time.Time
+}
+
+// Summarises the users matching the query's filters, without fetching them, so clients can revalidate cached listings
+func (svc *UserService) GetAllUsersStamp(ctx context.Context, query *UserQuery) (*UsersStamp, error) {
+	defer svc.Metrics.TimeService("UserService", "GetAllUsersStamp")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.GetAllUsersStamp")
+	defer span.End()
+
+	// Users saved before updated_at was tracked were last modified when they were created
+	var result struct {
+		Count       int64
+		LastUpdated database.NullTime
+	}
+	err := svc.retry(ctx, "GetAllUsersStamp", func() error {
+		err := query.filter(svc.db(ctx).Model(&models.User{})).
+			Select("COUNT(*) AS count, MAX(COALESCE(updated_at, created_at)) AS last_updated").
+			Scan(&result).Error
+		return dbError(err)
+	})
 	if err != nil {
 		return nil, err
+	}
+
+	stamp := &UsersStamp{Count: result.Count, LastUpdated: result.LastUpdated.Time}
+	return stamp, nil
+}
+
+func (svc *UserService) GetUser(ctx context.Context, id int) (*models.User, error) {
+	defer svc.Metrics.TimeService("UserService", "GetUser")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.GetUser")
+	defer span.End()
+
+	var user *models.User
+	err := svc.retry(ctx, "GetUser", func() (err error) {
+		user, err = findUser(svc.db(ctx), id)
+		return err
+	})
+	return user, err
+}
+
+func findUser(db *gorm.DB, id int) (*models.User, error) {
+	var user models.User
+	err := db.Find(&user, "id = ?", id).Error
+	if err != nil {
+		return nil, dbError(err)
 	} else if user.ID == 0 {
-		return nil, fiber.NewError(fiber.StatusNotFound, "user does not exist")
+		return nil, apperrors.New(apperrors.UserNotFound, "user does not exist")
 	}
 	return &user, nil
 }
 
-func (svc *UserService) UpdateUser(id int, firstName, lastName *string) (*models.User, error) {
-	user, err := svc.GetUser(id)
+// Sets every field that is non-nil, including to an empty string, leaving nil fields unchanged
+func (svc *UserService) UpdateUser(ctx context.Context, id int, firstName, lastName *string, precondition *Precondition) (*models.User, error) {
+	defer svc.Metrics.TimeService("UserService", "UpdateUser")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.UpdateUser")
+	defer span.End()
+
+	user, err := svc.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !precondition.Allows(user) {
+		return nil, errUserModified
+	}
+
+	changes := map[string]interface{}{}
+	if firstName != nil {
+		changes["first_name"] = *firstName
+	}
+	if lastName != nil {
+		changes["last_name"] = *lastName
+	}
+
+	err = svc.updateVersioned(svc.db(ctx), user, changes)
 	if err != nil {
 		return nil, err
 	}
-	if firstName != nil && *firstName != "" {
+	if firstName != nil {
 		user.FirstName = *firstName
 	}
-	if lastName != nil && *lastName != "" {
+	if lastName != nil {
 		user.LastName = *lastName
 	}
 
-	err = svc.DB.Conn.Save(user).Error
+	return user, nil
+}
 
-	return user, err
+// Soft deletes the user, so that it can later be restored
+func (svc *UserService) DeleteUser(ctx context.Context, id int, precondition *Precondition) error {
+	defer svc.Metrics.TimeService("UserService", "DeleteUser")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.DeleteUser")
+	defer span.End()
+
+	user, err := svc.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !precondition.Allows(user) {
+		return errUserModified
+	}
+
+	err = svc.updateVersioned(svc.db(ctx), user, map[string]interface{}{"deleted_at": svc.DB.Conn.NowFunc()})
+	if err != nil {
+		return err
+	}
+	loggerOrDefault(svc.Logger).InfoContext(ctx, "User deleted.", "user_id", id)
+	return nil
 }
 
-func (svc *UserService) DeleteUser(id int) error {
-	user, err := svc.GetUser(id)
+// Undoes a soft delete
+func (svc *UserService) RestoreUser(ctx context.Context, id int) (*models.User, error) {
+	defer svc.Metrics.TimeService("UserService", "RestoreUser")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.RestoreUser")
+	defer span.End()
+
+	user, err := findUser(svc.db(ctx).Unscoped(), id)
+	if err != nil {
+		return nil, err
+	}
+	if !user.DeletedAt.Valid {
+		return nil, apperrors.New(apperrors.UserNotDeleted, "user is not deleted")
+	}
+
+	err = svc.updateVersioned(svc.db(ctx).Unscoped(), user, map[string]interface{}{"deleted_at": nil})
+	if err != nil {
+		return nil, err
+	}
+
+	user.DeletedAt = gorm.DeletedAt{}
+	loggerOrDefault(svc.Logger).InfoContext(ctx, "User restored.", "user_id", id)
+	return user, nil
+}
+
+// Permanently removes the user, whether or not it has been soft deleted
+func (svc *UserService) PurgeUser(ctx context.Context, id int, precondition *Precondition) error {
+	defer svc.Metrics.TimeService("UserService", "PurgeUser")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.PurgeUser")
+	defer span.End()
+
+	user, err := findUser(svc.db(ctx).Unscoped(), id)
 	if err != nil {
 		return err
 	}
+	if !precondition.Allows(user) {
+		return errUserModified
+	}
+
+	result := svc.db(ctx).Unscoped().Where("version = ?", user.Version).Delete(user)
+	if result.Error != nil {
+		return dbError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errUserModified
+	}
+	loggerOrDefault(svc.Logger).InfoContext(ctx, "User purged.", "user_id", id)
+	return nil
+}
+
+// Applies the changes and bumps the version, but only if nobody else has done so since the user was read:
+// UPDATE users SET ..., version = version + 1 WHERE id = ? AND version = ?
+func (svc *UserService) updateVersioned(db *gorm.DB, user *models.User, changes map[string]interface{}) error {
+	now := db.NowFunc()
+	changes["version"] = gorm.Expr("version + 1")
+	changes["updated_at"] = now
+
+	result := db.Model(&models.User{}).Where("id = ? AND version = ?", user.ID, user.Version).Updates(changes)
+	if result.Error != nil {
+		return dbError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errUserModified
+	}
 
-	return svc.DB.Conn.Delete(user).Error
+	user.Version++
+	user.UpdatedAt = now
+	return nil
 }
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/models"
+	"gorm.io/gorm"
+)
+
+// The position of the last user on a page, used as the starting point of the next one.
+// Values holds the user's value for every field in the query's ordering, ID included.
+type Cursor struct {
+	Sort   string   `json:"s"`
+	Values []string `json:"v"`
+}
+
+var errInvalidCursor = apperrors.New(apperrors.InvalidCursor, "invalid cursor")
+
+// Serializes the cursor as "<payload>.<signature>", both base64url encoded,
+// so that clients can't forge positions or tamper with the sort order.
+func EncodeCursor(secret []byte, cursor *Cursor) (string, error) {
+	payload, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString(payload) + "." + encoding.EncodeToString(signCursor(secret, payload)), nil
+}
+
+func DecodeCursor(secret []byte, token string) (*Cursor, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed cursor")
+	}
+
+	encoding := base64.RawURLEncoding
+	payload, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	signature, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	if !hmac.Equal(signature, signCursor(secret, payload)) {
+		return nil, errors.New("cursor signature mismatch")
+	}
+
+	cursor := &Cursor{}
+	if err := json.Unmarshal(payload, cursor); err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return cursor, nil
+}
+
+func signCursor(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Canonical form of the query's ordering, e.g. "-created_at,id"
+func (query *UserQuery) sortKey() string {
+	var fields []string
+	for _, field := range query.ordering() {
+		if field.Descending {
+			fields = append(fields, "-"+field.Field)
+		} else {
+			fields = append(fields, field.Field)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+func (query *UserQuery) cursorFor(user *models.User) *Cursor {
+	cursor := &Cursor{Sort: query.sortKey()}
+	for _, field := range query.ordering() {
+		var value string
+		switch field.Field {
+		case "id":
+			value = strconv.FormatUint(uint64(user.ID), 10)
+		case "first_name":
+			value = user.FirstName
+		case "last_name":
+			value = user.LastName
+		case "created_at":
+			value = user.CreatedAt.UTC().Format(time.RFC3339Nano)
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+	return cursor
+}
+
+// Restricts the query to rows that sort strictly after the cursor, i.e. for an ordering of (a, -b, id):
+// (a > ?) OR (a = ? AND b < ?) OR (a = ? AND b = ? AND id > ?)
+func (query *UserQuery) seek(db *gorm.DB, cursor *Cursor) (*gorm.DB, error) {
+	ordering := query.ordering()
+	if cursor.Sort != query.sortKey() || len(cursor.Values) != len(ordering) {
+		return nil, errors.New("cursor does not match the requested sort order")
+	}
+
+	values := make([]interface{}, len(ordering))
+	for i, field := range ordering {
+		switch field.Field {
+		case "id":
+			id, err := strconv.ParseUint(cursor.Values[i], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = id
+		case "created_at":
+			createdAt, err := time.Parse(time.RFC3339Nano, cursor.Values[i])
+			if err != nil {
+				return nil, err
+			}
+			// Bind in UTC, matching how timestamps are written by the app
+			values[i] = createdAt.UTC()
+		default:
+			values[i] = cursor.Values[i]
+		}
+	}
+
+	var conditions []string
+	var args []interface{}
+	for i, field := range ordering {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, userSortColumns[ordering[j].Field]+" = ?")
+			args = append(args, values[j])
+		}
+
+		operator := ">"
+		if field.Descending {
+			operator = "<"
+		}
+		terms = append(terms, fmt.Sprintf("%s %s ?", userSortColumns[field.Field], operator))
+		args = append(args, values[i])
+
+		conditions = append(conditions, "("+strings.Join(terms, " AND ")+")")
+	}
+
+	return db.Where(strings.Join(conditions, " OR "), args...), nil
+}
+
+// Returns the page of users following the position encoded in the token,
+// or the first page if the token is empty. The returned token is empty once there are no more users.
+func (svc *UserService) GetUsersByCursor(ctx context.Context, query *UserQuery, token string) ([]models.User, string, error) {
+	defer svc.Metrics.TimeService("UserService", "GetUsersByCursor")()
+	ctx, span := startSpan(ctx, svc.Tracer, "UserService.GetUsersByCursor")
+	defer span.End()
+
+	db := query.filter(svc.db(ctx))
+
+	if token != "" {
+		cursor, err := DecodeCursor(svc.CursorSecret, token)
+		if err != nil {
+			return nil, "", errInvalidCursor
+		}
+		if db, err = query.seek(db, cursor); err != nil {
+			return nil, "", errInvalidCursor
+		}
+	}
+
+	// Fetch one extra row to find out if there is another page
+	users := []models.User{}
+	err := svc.retry(ctx, "GetUsersByCursor", func() error {
+		return dbError(query.order(db).Limit(query.Limit + 1).Find(&users).Error)
+	})
+	if err != nil || len(users) <= query.Limit {
+		return users, "", err
+	}
+
+	users = users[:query.Limit]
+	next, err := EncodeCursor(svc.CursorSecret, query.cursorFor(&users[len(users)-1]))
+	return users, next, err
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultUserLimit = 20
+	MaxUserLimit     = 100
+)
+
+// Columns that user listings can be sorted by, keyed by their public name
+var userSortColumns = map[string]string{
+	"id":         "id",
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"created_at": "created_at",
+}
+
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// Describes which page of users to fetch and how to filter / order them
+type UserQuery struct {
+	Limit          int
+	Offset         int
+	FirstName      string
+	LastName       string
+	CreatedAfter   *time.Time // Inclusive
+	CreatedBefore  *time.Time // Exclusive
+	Sort           []SortField
+	IncludeDeleted bool
+}
+
+// Parses a sort expression such as "-created_at,last_name",
+// where a leading "-" denotes descending order.
+func ParseUserSort(expression string) ([]SortField, error) {
+	var fields []SortField
+	seen := map[string]bool{}
+
+	for _, part := range strings.Split(expression, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		field := SortField{Field: strings.TrimPrefix(part, "-"), Descending: strings.HasPrefix(part, "-")}
+		if _, ok := userSortColumns[field.Field]; !ok {
+			return nil, fmt.Errorf("cannot sort by '%s'", field.Field)
+		}
+		if seen[field.Field] {
+			return nil, fmt.Errorf("cannot sort by '%s' more than once", field.Field)
+		}
+		seen[field.Field] = true
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// Applies the filters, without paging or ordering, so it can be reused for counting
+func (query *UserQuery) filter(db *gorm.DB) *gorm.DB {
+	if query.IncludeDeleted {
+		db = db.Unscoped()
+	}
+	if query.FirstName != "" {
+		db = db.Where("first_name = ?", query.FirstName)
+	}
+	if query.LastName != "" {
+		db = db.Where("last_name = ?", query.LastName)
+	}
+	if query.CreatedAfter != nil {
+		db = db.Where("created_at >= ?", query.CreatedAfter.UTC())
+	}
+	if query.CreatedBefore != nil {
+		db = db.Where("created_at < ?", query.CreatedBefore.UTC())
+	}
+	return db
+}
+
+// The requested sort order, always ending with the ID so that pages are deterministic
+func (query *UserQuery) ordering() []SortField {
+	fields := append([]SortField{}, query.Sort...)
+	for _, field := range fields {
+		if field.Field == "id" {
+			return fields
+		}
+	}
+	return append(fields, SortField{Field: "id"})
+}
+
+func (query *UserQuery) order(db *gorm.DB) *gorm.DB {
+	for _, field := range query.ordering() {
+		column := userSortColumns[field.Field]
+		if field.Descending {
+			column += " DESC"
+		}
+		db = db.Order(column)
+	}
+	return db
+}
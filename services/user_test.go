@@ -1,13 +1,26 @@
 package services
 
 import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/conormkelly/fiber-demo/apperrors"
+	"github.com/conormkelly/fiber-demo/config"
 	"github.com/conormkelly/fiber-demo/database"
+	"github.com/conormkelly/fiber-demo/dberrors"
+	"github.com/conormkelly/fiber-demo/metrics"
+	"github.com/conormkelly/fiber-demo/migrations"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -22,21 +35,21 @@ func TestDatabaseDown(t *testing.T) {
 		{
 			description: "CreateUser with DB offline",
 			action: func(svc *UserService) error {
-				_, err := svc.CreateUser("Joe", "Bloggs")
+				_, err := svc.CreateUser(context.Background(), "Joe", "Bloggs")
 				return err
 			},
 		},
 		{
 			description: "GetAllUsers with DB offline",
 			action: func(svc *UserService) error {
-				_, err := svc.GetAllUsers()
+				_, _, err := svc.GetAllUsers(context.Background(), &UserQuery{Limit: DefaultUserLimit})
 				return err
 			},
 		},
 		{
 			description: "GetUser with DB offline",
 			action: func(svc *UserService) error {
-				_, err := svc.GetUser(1)
+				_, err := svc.GetUser(context.Background(), 1)
 				return err
 			},
 		},
@@ -45,21 +58,33 @@ func TestDatabaseDown(t *testing.T) {
 			action: func(svc *UserService) error {
 				firstName := "Joe"
 				lastName := "Bloggs"
-				_, err := svc.UpdateUser(1, &firstName, &lastName)
+				_, err := svc.UpdateUser(context.Background(), 1, &firstName, &lastName, nil)
 				return err
 			},
 		},
 		{
 			description: "DeleteUser with DB offline",
 			action: func(svc *UserService) error {
-				return svc.DeleteUser(1)
+				return svc.DeleteUser(context.Background(), 1, nil)
+			},
+		},
+		{
+			description: "RestoreUser with DB offline",
+			action: func(svc *UserService) error {
+				_, err := svc.RestoreUser(context.Background(), 1)
+				return err
+			},
+		},
+		{
+			description: "PurgeUser with DB offline",
+			action: func(svc *UserService) error {
+				return svc.PurgeUser(context.Background(), 1, nil)
 			},
 		},
 	}
 
 	// Test setup / arrangement
-	connectionString := "file:user_service_test?mode=memory&cache=shared"
-	conn, err := gorm.Open(sqlite.Open(connectionString), &gorm.Config{})
+	conn, err := openTestDB("memory://user_service_test")
 	db := &database.Database{Conn: conn}
 
 	if err != nil {
@@ -86,21 +111,21 @@ func TestNonExistentTable(t *testing.T) {
 		{
 			description: "CreateUser with no users table",
 			action: func(svc *UserService) error {
-				_, err := svc.CreateUser("Joe", "Bloggs")
+				_, err := svc.CreateUser(context.Background(), "Joe", "Bloggs")
 				return err
 			},
 		},
 		{
 			description: "GetAllUsers with no users table",
 			action: func(svc *UserService) error {
-				_, err := svc.GetAllUsers()
+				_, _, err := svc.GetAllUsers(context.Background(), &UserQuery{Limit: DefaultUserLimit})
 				return err
 			},
 		},
 		{
 			description: "GetUser with no users table",
 			action: func(svc *UserService) error {
-				_, err := svc.GetUser(1)
+				_, err := svc.GetUser(context.Background(), 1)
 				return err
 			},
 		},
@@ -109,30 +134,41 @@ func TestNonExistentTable(t *testing.T) {
 			action: func(svc *UserService) error {
 				firstName := "Joe"
 				lastName := "Bloggs"
-				_, err := svc.UpdateUser(1, &firstName, &lastName)
+				_, err := svc.UpdateUser(context.Background(), 1, &firstName, &lastName, nil)
 				return err
 			},
 		},
 		{
 			description: "DeleteUser with no users table",
 			action: func(svc *UserService) error {
-				return svc.DeleteUser(1)
+				return svc.DeleteUser(context.Background(), 1, nil)
+			},
+		},
+		{
+			description: "RestoreUser with no users table",
+			action: func(svc *UserService) error {
+				_, err := svc.RestoreUser(context.Background(), 1)
+				return err
+			},
+		},
+		{
+			description: "PurgeUser with no users table",
+			action: func(svc *UserService) error {
+				return svc.PurgeUser(context.Background(), 1, nil)
 			},
 		},
 	}
 
 	// Test setup / arrangement
-	connectionString := "file:user_test_no_tables?mode=memory&cache=shared"
-	conn, err := gorm.Open(sqlite.Open(connectionString), &gorm.Config{})
+	conn, err := openTestDB("memory://user_test_no_tables")
 	if err != nil {
 		log.Fatal("Database failed to connect: " + err.Error())
 	}
 	db := &database.Database{Conn: conn}
 	// Deliberately creating a DB without any tables,
-	// i.e. automigrations are not being run:
+	// i.e. migrations are not being run:
 
-	// modelsToMigrate := []interface{}{&models.User{}}
-	// db.Conn.AutoMigrate(modelsToMigrate...)
+	// migrate(db.Conn)
 
 	userService := &UserService{DB: db}
 
@@ -140,6 +176,313 @@ func TestNonExistentTable(t *testing.T) {
 	executeDbTests(userService, t, testCases, &expectedErrorMessage)
 }
 
+// Confirm that keyset pages neither skip nor repeat users when rows are inserted between requests
+func TestGetUsersByCursor(t *testing.T) {
+	conn, err := openTestDB("memory://user_cursor_test")
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	migrate(conn)
+	userService := &UserService{DB: &database.Database{Conn: conn}, CursorSecret: []byte("secret")}
+
+	for _, name := range []string{"Bravo", "Delta", "Foxtrot"} {
+		userService.CreateUser(context.Background(), name, "Test")
+	}
+
+	query := &UserQuery{Limit: 2, Sort: []SortField{{Field: "first_name"}}}
+	firstPage, cursor, err := userService.GetUsersByCursor(context.Background(), query, "")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, cursor)
+
+	// A user sorting before the cursor would shift every later row in offset pagination
+	userService.CreateUser(context.Background(), "Alpha", "Test")
+
+	secondPage, cursor, err := userService.GetUsersByCursor(context.Background(), query, cursor)
+	assert.Nil(t, err)
+	assert.Empty(t, cursor)
+
+	var names []string
+	for _, user := range append(firstPage, secondPage...) {
+		names = append(names, user.FirstName)
+	}
+	assert.Equal(t, []string{"Bravo", "Delta", "Foxtrot"}, names)
+
+	// The cursor is bound to the sort order it was issued for
+	_, cursor, _ = userService.GetUsersByCursor(context.Background(), query, "")
+	_, _, err = userService.GetUsersByCursor(context.Background(), &UserQuery{Limit: 2}, cursor)
+	assert.Equal(t, "invalid cursor", err.Error())
+}
+
+// Confirm that cursors keep working when the process that reads a page isn't in the time zone of the one that wrote the users
+func TestGetUsersByCursorTimeZones(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+
+	conn, err := openTestDB("memory://user_cursor_tz_test")
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	migrate(conn)
+	userService := &UserService{DB: &database.Database{Conn: conn}, CursorSecret: []byte("secret")}
+
+	time.Local = time.FixedZone("UTC+2", 2*60*60)
+	for _, name := range []string{"Alpha", "Bravo", "Charlie", "Delta"} {
+		userService.CreateUser(context.Background(), name, "Test")
+	}
+
+	var stored string
+	conn.Raw("SELECT CAST(created_at AS TEXT) FROM users LIMIT 1").Scan(&stored)
+	assert.True(t, strings.HasSuffix(stored, "+00:00"), "expected a UTC timestamp, got %s", stored)
+
+	time.Local = time.FixedZone("UTC-5", -5*60*60)
+	query := &UserQuery{Limit: 1, Sort: []SortField{{Field: "created_at"}}}
+	var names []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		users, next, err := userService.GetUsersByCursor(context.Background(), query, cursor)
+		assert.Nil(t, err)
+		for _, user := range users {
+			names = append(names, user.FirstName)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"Alpha", "Bravo", "Charlie", "Delta"}, names)
+}
+
+// Confirm that users saved before updated_at was tracked count as last modified when they were created
+func TestGetAllUsersStamp(t *testing.T) {
+	conn, err := openTestDB("memory://user_stamp_test")
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	migrate(conn)
+	userService := &UserService{DB: &database.Database{Conn: conn}}
+
+	stamp, err := userService.GetAllUsersStamp(context.Background(), &UserQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stamp.Count)
+	assert.True(t, stamp.LastUpdated.IsZero())
+
+	older, _ := userService.CreateUser(context.Background(), "Joe", "Bloggs")
+	newer, _ := userService.CreateUser(context.Background(), "Jane", "Bloggs")
+	createdAt := newer.CreatedAt.Add(time.Hour)
+	conn.Exec("UPDATE users SET updated_at = NULL, created_at = ? WHERE id = ?", createdAt, newer.ID)
+
+	stamp, err = userService.GetAllUsersStamp(context.Background(), &UserQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), stamp.Count)
+	assert.True(t, createdAt.Equal(stamp.LastUpdated), "expected %s, got %s", createdAt, stamp.LastUpdated)
+
+	stamp, err = userService.GetAllUsersStamp(context.Background(), &UserQuery{FirstName: "Joe"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), stamp.Count)
+	assert.True(t, older.UpdatedAt.Equal(stamp.LastUpdated), "expected %s, got %s", older.UpdatedAt, stamp.LastUpdated)
+}
+
+// Confirm that fields can be explicitly cleared, while nil fields are left untouched
+func TestUpdateUserFields(t *testing.T) {
+	conn, err := openTestDB("memory://user_update_test")
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	migrate(conn)
+	userService := &UserService{DB: &database.Database{Conn: conn}}
+
+	user, _ := userService.CreateUser(context.Background(), "Joe", "Bloggs")
+
+	empty := ""
+	updated, err := userService.UpdateUser(context.Background(), int(user.ID), nil, &empty, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Joe", updated.FirstName)
+	assert.Equal(t, "", updated.LastName)
+
+	reloaded, _ := userService.GetUser(context.Background(), int(user.ID))
+	assert.Equal(t, "", reloaded.LastName)
+}
+
+// Confirm that a write based on a stale read is rejected rather than silently overwriting a newer version
+func TestUpdateUserLostUpdate(t *testing.T) {
+	conn, err := openTestDB("memory://user_version_test")
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	migrate(conn)
+	userService := &UserService{DB: &database.Database{Conn: conn}}
+
+	user, _ := userService.CreateUser(context.Background(), "Joe", "Bloggs")
+	id := int(user.ID)
+
+	// Two clients read version 1
+	firstRead, _ := userService.GetUser(context.Background(), id)
+	secondRead, _ := userService.GetUser(context.Background(), id)
+	assert.Equal(t, uint(1), firstRead.Version)
+
+	firstName := "Joseph"
+	updated, err := userService.UpdateUser(context.Background(), id, &firstName, nil, &Precondition{Versions: []uint{firstRead.Version}})
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), updated.Version)
+
+	lastName := "Blogs"
+	_, err = userService.UpdateUser(context.Background(), id, nil, &lastName, &Precondition{Versions: []uint{secondRead.Version}})
+	assert.Equal(t, "user has been modified", err.Error())
+
+	// Even without a precondition, the conditional UPDATE guards the read-then-write window
+	err = userService.updateVersioned(conn, secondRead, map[string]interface{}{"last_name": lastName})
+	assert.Equal(t, errUserModified, err)
+
+	reloaded, _ := userService.GetUser(context.Background(), id)
+	assert.Equal(t, "Joseph", reloaded.FirstName)
+	assert.Equal(t, "Bloggs", reloaded.LastName)
+	assert.Equal(t, uint(2), reloaded.Version)
+}
+
+// Confirm that database errors clients can act on are given a code and status, rather than becoming a 500
+func TestDatabaseErrors(t *testing.T) {
+	// The busy timeout is turned off, so that a locked database fails straight away
+	connectionString := "sqlite://" + filepath.Join(t.TempDir(), "users.db") + "?_busy_timeout=0"
+	conn, err := openTestDB(connectionString)
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	// The users table, with constraints that the migrations don't have
+	err = conn.Exec(`CREATE TABLE users (
+		id integer PRIMARY KEY, created_at datetime, updated_at datetime, deleted_at datetime,
+		version integer NOT NULL DEFAULT 1, first_name text CHECK (length(first_name) <= 20), last_name text,
+		UNIQUE (first_name, last_name)
+	)`).Error
+	if err != nil {
+		log.Fatal("Failed to create the users table: " + err.Error())
+	}
+	userService := &UserService{DB: &database.Database{Conn: conn}}
+	userService.CreateUser(context.Background(), "Joe", "Bloggs")
+
+	// A second connection holding the write lock
+	lockingConn, err := openTestDB(connectionString)
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+
+	testCases := []struct {
+		description    string
+		action         func() error
+		expectedCode   apperrors.Code
+		expectedStatus int
+	}{
+		{
+			description: "Duplicate unique key",
+			action: func() error {
+				_, err := userService.CreateUser(context.Background(), "Joe", "Bloggs")
+				return err
+			},
+			expectedCode:   apperrors.Conflict,
+			expectedStatus: 409,
+		},
+		{
+			description: "Check constraint on create",
+			action: func() error {
+				_, err := userService.CreateUser(context.Background(), strings.Repeat("Joe", 10), "Bloggs")
+				return err
+			},
+			expectedCode:   apperrors.InvalidInput,
+			expectedStatus: 422,
+		},
+		{
+			description: "Check constraint on update",
+			action: func() error {
+				firstName := strings.Repeat("Joe", 10)
+				_, err := userService.UpdateUser(context.Background(), 1, &firstName, nil, nil)
+				return err
+			},
+			expectedCode:   apperrors.InvalidInput,
+			expectedStatus: 422,
+		},
+		{
+			description: "Database locked by another writer",
+			action: func() error {
+				tx := lockingConn.Begin()
+				defer tx.Rollback()
+				_, err := userService.CreateUser(context.Background(), "Jane", "Doe")
+				return err
+			},
+			expectedCode:   apperrors.DatabaseUnavailable,
+			expectedStatus: 503,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprintf("%s - %s", t.Name(), test.description), func(t *testing.T) {
+			err := test.action()
+			assert.True(t, apperrors.Is(err, test.expectedCode), "%s: got %v", test.description, err)
+			assert.Equal(t, test.expectedStatus, apperrors.From(err).Status(), test.description)
+		})
+	}
+
+	var appError *apperrors.Error
+	_, err = userService.CreateUser(context.Background(), "Joe", "Bloggs")
+	assert.True(t, errors.As(err, &appError))
+	assert.Equal(t, time.Duration(0), appError.RetryAfter)
+	assert.Equal(t, dberrors.Conflict, dberrors.Classify(appError.Err), "the driver's error is kept for logs")
+
+	tx := lockingConn.Begin()
+	_, err = userService.CreateUser(context.Background(), "Jane", "Doe")
+	tx.Rollback()
+	assert.True(t, errors.As(err, &appError))
+	assert.Equal(t, time.Second, appError.RetryAfter, "clients are told when to retry")
+}
+
+// Confirm that calls that only read are retried on dropped connections, and that the retries are logged and counted
+func TestRetries(t *testing.T) {
+	conn, err := openTestDB("memory://user_retry_test")
+	if err != nil {
+		log.Fatal("Database failed to connect: " + err.Error())
+	}
+	migrate(conn)
+
+	// Drops the connection of the next queries and inserts
+	failures := 0
+	dropConnection := func(db *gorm.DB) {
+		if failures > 0 {
+			failures--
+			db.AddError(driver.ErrBadConn)
+		}
+	}
+	conn.Callback().Query().Before("gorm:query").Register("test:drop_connection", dropConnection)
+	conn.Callback().Create().Before("gorm:create").Register("test:drop_connection", dropConnection)
+
+	var logs bytes.Buffer
+	userService := &UserService{
+		DB:      &database.Database{Conn: conn},
+		Metrics: metrics.New(),
+		Logger:  slog.New(slog.NewTextHandler(&logs, nil)),
+		Retry:   database.Retry{Attempts: 2, BaseDelay: time.Millisecond},
+	}
+	user, _ := userService.CreateUser(context.Background(), "Joe", "Bloggs")
+
+	failures = 2
+	found, err := userService.GetUser(context.Background(), int(user.ID))
+	assert.Nil(t, err)
+	assert.Equal(t, "Joe", found.FirstName)
+	assert.Contains(t, logs.String(), `msg="Retrying database call." operation=UserService.GetUser attempt=2`)
+
+	failures = 3
+	_, err = userService.GetUser(context.Background(), int(user.ID))
+	assert.True(t, apperrors.Is(err, apperrors.DatabaseUnavailable), "the last error is returned once the attempts run out")
+
+	failures = 1
+	_, err = userService.CreateUser(context.Background(), "Jane", "Doe")
+	assert.True(t, apperrors.Is(err, apperrors.DatabaseUnavailable), "writes aren't retried, as they may have been applied")
+
+	err = testutil.GatherAndCompare(userService.Metrics.Registry, strings.NewReader(`
+# HELP db_retries_total Database operations retried after a deadlock or dropped connection, by operation e.g. connect or UserService.GetUser.
+# TYPE db_retries_total counter
+db_retries_total{operation="UserService.GetUser"} 4
+`), "db_retries_total")
+	assert.Nil(t, err)
+}
+
 func executeDbTests(svc *UserService, t *testing.T, testCases []databaseTest, expectedErrorMessage *string) {
 	for _, test := range testCases {
 		t.Run(fmt.Sprintf("%s - %s", t.Name(), test.description), func(t *testing.T) {
@@ -149,3 +492,19 @@ func executeDbTests(svc *UserService, t *testing.T, testCases []databaseTest, ex
 		})
 	}
 }
+
+// Opens a DB through the same path as the app, without running any migrations
+func openTestDB(connectionString string) (*gorm.DB, error) {
+	return database.GetConnection(&database.Options{ConnectionString: config.Secret(connectionString)})
+}
+
+// Applies every migration to a test DB
+func migrate(conn *gorm.DB) {
+	migrator, err := migrations.New(conn)
+	if err == nil {
+		_, err = migrator.Up()
+	}
+	if err != nil {
+		log.Fatal("Failed to migrate: " + err.Error())
+	}
+}
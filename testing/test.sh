@@ -1,6 +1,7 @@
 #!/bin/bash
 
-docker compose --profile tests up --detach
+# The collection doesn't sign tokens, so the tests run with authentication disabled
+docker compose -f docker-compose.yml -f docker-compose.noauth.yml --profile tests up --detach
 echo "Sleeping for 10 seconds..." && sleep 10 # TODO: find a better way of making this more consistent
-docker compose logs newman
-docker compose down
+docker compose -f docker-compose.yml -f docker-compose.noauth.yml logs newman
+docker compose -f docker-compose.yml -f docker-compose.noauth.yml down
@@ -0,0 +1,183 @@
+// Package tracing creates the app's OpenTelemetry tracer provider, and traces HTTP requests with W3C trace context
+// propagation, so that the time taken by Fiber, the services and the database can be told apart.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/conormkelly/fiber-demo/routes"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Name of the tracers created by the app's packages
+const InstrumentationName = "github.com/conormkelly/fiber-demo"
+
+// Exporters
+const (
+	None   = "none"
+	OTLP   = "otlp"   // OTLP over HTTP, configured by Endpoint or the standard OTEL_EXPORTER_OTLP_* variables
+	Stdout = "stdout" // One JSON object per span, for local use
+	File   = "file"   // As stdout, but appended to File
+)
+
+type Options struct {
+	Exporter    string
+	Endpoint    string  // OTLP endpoint URL e.g. "http://localhost:4318"
+	File        string  // Path spans are written to by the file exporter
+	ServiceName string  // Reported as service.name
+	SampleRatio float64 // Fraction of new traces that are recorded, traces started by callers follow their sampling decision
+}
+
+type Tracing struct {
+	Provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+	shutdown   func(context.Context) error
+}
+
+// Tracing that records nothing, e.g. when no exporter is configured
+func Disabled() *Tracing {
+	return &Tracing{
+		Provider:   noop.NewTracerProvider(),
+		propagator: propagation.TraceContext{},
+		shutdown:   func(context.Context) error { return nil },
+	}
+}
+
+// Creates a tracer provider exporting spans in batches to the configured exporter
+func New(ctx context.Context, options Options) (*Tracing, error) {
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch strings.ToLower(options.Exporter) {
+	case None, "":
+		return Disabled(), nil
+	case OTLP:
+		var otlpOptions []otlptracehttp.Option
+		if options.Endpoint != "" {
+			otlpOptions = append(otlpOptions, otlptracehttp.WithEndpointURL(options.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, otlpOptions...)
+	case Stdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case File:
+		if options.File == "" {
+			return nil, fmt.Errorf("the file exporter needs a file")
+		}
+		file, openErr := os.OpenFile(options.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if openErr != nil {
+			return nil, openErr
+		}
+		closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown exporter '%s', expected none, otlp, stdout or file", options.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithExporter(exporter, options, closer)
+}
+
+// Creates a tracer provider for an exporter, e.g. an in-memory one in tests. closer, if not nil, is closed on shutdown.
+func NewWithExporter(exporter sdktrace.SpanExporter, options Options, closer io.Closer) (*Tracing, error) {
+	serviceResource, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(options.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(serviceResource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+	)
+	return &Tracing{
+		Provider:   provider,
+		propagator: propagation.TraceContext{},
+		shutdown: func(ctx context.Context) error {
+			err := provider.Shutdown(ctx)
+			if closer != nil {
+				if closeErr := closer.Close(); err == nil {
+					err = closeErr
+				}
+			}
+			return err
+		},
+	}, nil
+}
+
+func (t *Tracing) Tracer() trace.Tracer {
+	return t.Provider.Tracer(InstrumentationName)
+}
+
+// Exports any spans that haven't been yet, then stops the exporter
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	return t.shutdown(ctx)
+}
+
+// Starts a span for every request, continuing the trace in its traceparent header if there is one.
+// The span is put in the request's user context so that services and queries are traced as its children,
+// so this must be registered after anything that replaces the user context, and before errors are rendered.
+func (t *Tracing) Middleware() fiber.Handler {
+	tracer := t.Tracer()
+	return func(ctx *fiber.Ctx) error {
+		parent := t.propagator.Extract(ctx.UserContext(), headerCarrier{ctx})
+		spanCtx, span := tracer.Start(parent, ctx.Method(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(ctx.Method()),
+				semconv.URLPath(ctx.Path()),
+				semconv.UserAgentOriginal(ctx.Get(fiber.HeaderUserAgent)),
+			),
+		)
+		defer span.End()
+		ctx.SetUserContext(spanCtx)
+
+		err := ctx.Next()
+
+		// The route is only known once the request has been routed, and is unmatched if it was answered before then
+		route := routes.Template(ctx)
+		status := ctx.Response().StatusCode()
+		span.SetName(ctx.Method() + " " + route)
+		span.SetAttributes(attribute.String(string(semconv.HTTPRouteKey), route), semconv.HTTPResponseStatusCode(status))
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, fmt.Sprint(status))
+		}
+		return err
+	}
+}
+
+// Reads and writes trace context headers on a Fiber request
+type headerCarrier struct {
+	ctx *fiber.Ctx
+}
+
+func (carrier headerCarrier) Get(key string) string {
+	return carrier.ctx.Get(key)
+}
+
+func (carrier headerCarrier) Set(key, value string) {
+	carrier.ctx.Request().Header.Set(key, value)
+}
+
+func (carrier headerCarrier) Keys() []string {
+	var keys []string
+	carrier.ctx.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
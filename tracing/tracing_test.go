@@ -0,0 +1,35 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	traces, err := New(context.Background(), Options{Exporter: File, File: path, ServiceName: "test", SampleRatio: 1})
+	assert.Nil(t, err)
+
+	_, span := traces.Tracer().Start(context.Background(), "UserService.GetUser")
+	span.End()
+	assert.Nil(t, traces.Shutdown(context.Background()))
+
+	contents, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(contents), `"Name":"UserService.GetUser"`, "spans are flushed on shutdown")
+	assert.Contains(t, string(contents), `"Value":"test"`, "the service name is exported")
+
+	disabled, err := New(context.Background(), Options{Exporter: None})
+	assert.Nil(t, err)
+	_, span = disabled.Tracer().Start(context.Background(), "UserService.GetUser")
+	assert.False(t, span.IsRecording())
+
+	_, err = New(context.Background(), Options{Exporter: "zipkin"})
+	assert.Equal(t, "unknown exporter 'zipkin', expected none, otlp, stdout or file", err.Error())
+	_, err = New(context.Background(), Options{Exporter: File})
+	assert.Equal(t, "the file exporter needs a file", err.Error())
+}
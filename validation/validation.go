@@ -0,0 +1,149 @@
+package validation
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Describes why a single field failed validation, in a form clients can act on
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// Returned when a struct fails validation, holding every failing field
+type Error struct {
+	Fields []FieldError
+}
+
+func (e *Error) Error() string {
+	return "validation failed"
+}
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+
+	// Report fields by the name clients know them by
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterValidation("personname", isPersonName)
+
+	return v
+}
+
+// Letters (in any script), spaces, hyphens and apostrophes e.g. "Mary-Jane O'Neill"
+func isPersonName(fl validator.FieldLevel) bool {
+	for _, r := range fl.Field().String() {
+		if !unicode.IsLetter(r) && !unicode.IsMark(r) && r != ' ' && r != '-' && r != '\'' {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalizes and then validates a struct, based on its `normalize` and `validate` tags, e.g.
+//
+//	FirstName string `json:"first_name" normalize:"trim" validate:"required,max=100"`
+func Struct(target interface{}) error {
+	normalize(reflect.ValueOf(target))
+
+	err := validate.Struct(target)
+	if err == nil {
+		return nil
+	}
+
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
+
+	fields := make([]FieldError, len(validationErrors))
+	for i, fieldError := range validationErrors {
+		fields[i] = FieldError{
+			Field:   fieldError.Field(),
+			Rule:    fieldError.Tag(),
+			Param:   fieldError.Param(),
+			Message: message(fieldError),
+		}
+	}
+	return &Error{Fields: fields}
+}
+
+func message(fieldError validator.FieldError) string {
+	switch fieldError.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		if fieldError.Kind() == reflect.Slice {
+			return fmt.Sprintf("must contain at least %s items", fieldError.Param())
+		}
+		return fmt.Sprintf("must be at least %s characters long", fieldError.Param())
+	case "max":
+		if fieldError.Kind() == reflect.Slice {
+			return fmt.Sprintf("must contain at most %s items", fieldError.Param())
+		}
+		return fmt.Sprintf("must be at most %s characters long", fieldError.Param())
+	case "gt":
+		// Without a param, times must be after the current time
+		if fieldError.Param() == "" {
+			return "must be in the future"
+		}
+		return fmt.Sprintf("must be greater than %s", fieldError.Param())
+	case "personname":
+		return "may only contain letters, spaces, hyphens and apostrophes"
+	default:
+		return fmt.Sprintf("failed the '%s' rule", fieldError.Tag())
+	}
+}
+
+// Applies `normalize` tags to string fields, recursing into nested structs
+func normalize(value reflect.Value) {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+
+		if field.Kind() == reflect.Ptr && !field.IsNil() && field.Elem().Kind() == reflect.String {
+			field = field.Elem()
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			for _, rule := range strings.Split(value.Type().Field(i).Tag.Get("normalize"), ",") {
+				switch rule {
+				case "trim":
+					field.SetString(strings.TrimSpace(field.String()))
+				case "lower":
+					field.SetString(strings.ToLower(field.String()))
+				}
+			}
+		case reflect.Struct, reflect.Ptr:
+			normalize(field)
+		}
+	}
+}